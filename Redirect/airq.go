@@ -1,16 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/netutil"
 )
 
 type Coordinates struct {
@@ -39,147 +61,2831 @@ var coordinates = map[string]Coordinates{
 	"Tsuen Wan":       {114.114535, 22.371742},
 }
 
-func getCachedData(key string, ttl int) ([]byte, bool) {
-	cacheFile := filepath.Join(os.TempDir(), fmt.Sprintf("aqhi_cache_%x", key))
-	info, err := os.Stat(cacheFile)
-	if err == nil && time.Since(info.ModTime()) < time.Duration(ttl)*time.Second {
-		data, err := ioutil.ReadFile(cacheFile)
-		if err == nil {
-			return data, true
+var defaultStationAliases = map[string]string{
+	"Eastern":             "Eastern Air",
+	"Central and Western": "Central/Western",
+	"Central & Western":   "Central/Western",
+	"Northern":            "North",
+	"Mongkok":             "Mong Kok",
+	"Shatin":              "Sha Tin",
+}
+
+var stationAliases = loadStationAliases()
+
+func loadStationAliases() map[string]string {
+	aliases := make(map[string]string, len(defaultStationAliases))
+	for alias, canonical := range defaultStationAliases {
+		aliases[strings.ToLower(alias)] = canonical
+	}
+
+	raw := os.Getenv("AQHI_STATION_ALIASES")
+	if raw == "" {
+		return aliases
+	}
+	var overrides map[string]string
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		log.Printf("Ignoring invalid AQHI_STATION_ALIASES: %s\n", err)
+		return aliases
+	}
+	for alias, canonical := range overrides {
+		if _, ok := coordinates[canonical]; !ok || strings.TrimSpace(alias) == "" {
+			log.Printf("Ignoring alias %q for unknown station %q in AQHI_STATION_ALIASES\n", alias, canonical)
+			continue
+		}
+		aliases[strings.ToLower(strings.TrimSpace(alias))] = canonical
+	}
+	return aliases
+}
+
+func canonicalStation(name string) (string, bool) {
+	lower := strings.ToLower(strings.TrimSpace(name))
+	for canonical := range coordinates {
+		if strings.ToLower(canonical) == lower {
+			return canonical, true
+		}
+	}
+	canonical, ok := stationAliases[lower]
+	return canonical, ok
+}
+
+var stationPriority = loadStationPriority()
+
+func loadStationPriority() map[string]int {
+	raw := os.Getenv("STATION_PRIORITY")
+	if raw == "" {
+		return nil
+	}
+	priority := make(map[string]int)
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		canonical, ok := canonicalStation(name)
+		if !ok {
+			log.Printf("Ignoring unknown station %q in STATION_PRIORITY\n", name)
+			continue
+		}
+		if _, seen := priority[canonical]; !seen {
+			priority[canonical] = len(priority)
+		}
+	}
+	return priority
+}
+
+func sortStations(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		rankI, prioritizedI := stationPriority[names[i]]
+		rankJ, prioritizedJ := stationPriority[names[j]]
+		switch {
+		case prioritizedI && prioritizedJ:
+			return rankI < rankJ
+		case prioritizedI != prioritizedJ:
+			return prioritizedI
+		default:
+			return names[i] < names[j]
+		}
+	})
+}
+
+type dataOptions struct {
+	last        bool
+	recent      bool
+	nocache     bool
+	resample    time.Duration
+	aqhiGT      *float64
+	pm25GT      *float64
+	blend       bool
+	emaAlpha    float64
+	extrapolate int
+	stations    []string
+	pollutants  []string
+	bbox        *[4]float64
+	from        time.Time
+	to          time.Time
+}
+
+var pollutants = []string{"aqhi", "NO2", "O3", "SO2", "CO", "PM10", "PM25"}
+
+const (
+	defaultUpstreamBaseURL = "https://www.aqhi.gov.hk"
+	pollutantPath          = "/js/data/past_24_pollutant.js"
+	pollutantVariable      = "station_24_data"
+	forecastPath           = "/js/data/forecast_aqhi.js"
+	defaultCacheTTL        = 300
+
+	defaultMemoryCacheSize = 16
+	defaultAQHICapValue    = 11
+
+	shutdownTimeout = 15 * time.Second
+
+	maxExtrapolateHours = 12
+	extrapolationWindow = 6
+)
+
+var upstreamBaseURL = loadUpstreamBaseURL()
+
+func loadUpstreamBaseURL() string {
+	raw := os.Getenv("AQHI_UPSTREAM_BASE_URL")
+	if raw == "" {
+		return defaultUpstreamBaseURL
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+		parsed.RawQuery != "" || parsed.Fragment != "" {
+		log.Printf("Ignoring invalid AQHI_UPSTREAM_BASE_URL %q, must be an http or https origin\n", redactURL(raw))
+		return defaultUpstreamBaseURL
+	}
+	return strings.TrimRight(raw, "/")
+}
+
+func pollutantURL() string {
+	return upstreamBaseURL + pollutantPath
+}
+
+func forecastURL() string {
+	return upstreamBaseURL + forecastPath
+}
+
+var defaultPollutantDecimals = map[string]int{
+	"aqhi": 0,
+	"NO2":  1,
+	"O3":   1,
+	"SO2":  1,
+	"CO":   2,
+	"PM10": 1,
+	"PM25": 1,
+}
+
+var pollutantUnits = map[string]string{
+	"aqhi": "index",
+	"NO2":  "µg/m³",
+	"O3":   "µg/m³",
+	"SO2":  "µg/m³",
+	"CO":   "µg/m³",
+	"PM10": "µg/m³",
+	"PM25": "µg/m³",
+}
+
+var pollutantDecimals = loadPollutantDecimals()
+var csvDecimals = loadCSVDecimals()
+
+var pollutantAliases = loadPollutantAliases()
+
+var hongKong = loadHongKongLocation()
+
+var httpClient = newHTTPClient()
+
+var debugEnabled, _ = strconv.ParseBool(os.Getenv("AQHI_DEBUG"))
+
+var resampleFill = loadResampleFill()
+
+var errorDetail = loadErrorDetail()
+
+var responseHeaders = loadResponseHeaders()
+
+var maxResponseFeatures = loadMaxResponseFeatures()
+
+var stationMetadata = loadStationMetadata()
+
+var maxDataAge = loadMaxDataAge()
+
+var cacheTTL = loadCacheTTL()
+
+func loadCacheTTL() int {
+	raw := os.Getenv("AQHI_CACHE_TTL")
+	if raw == "" {
+		return defaultCacheTTL
+	}
+	ttl, err := strconv.Atoi(raw)
+	if err != nil || ttl < 0 {
+		log.Printf("Ignoring invalid AQHI_CACHE_TTL %q\n", raw)
+		return defaultCacheTTL
+	}
+	return ttl
+}
+
+func loadMaxDataAge() time.Duration {
+	raw := os.Getenv("MAX_DATA_AGE")
+	if raw == "" {
+		return 0
+	}
+	age, err := time.ParseDuration(raw)
+	if err != nil || age < 0 {
+		log.Printf("Ignoring invalid MAX_DATA_AGE %q\n", raw)
+		return 0
+	}
+	return age
+}
+
+var maxConnections = loadMaxConnections()
+
+var maxQueryComplexity = loadMaxQueryComplexity()
+
+func loadMaxQueryComplexity() int {
+	raw := os.Getenv("MAX_QUERY_COMPLEXITY")
+	if raw == "" {
+		return 0
+	}
+	max, err := strconv.Atoi(raw)
+	if err != nil || max < 0 {
+		log.Printf("Ignoring invalid MAX_QUERY_COMPLEXITY %q\n", raw)
+		return 0
+	}
+	return max
+}
+
+func queryComplexity(query url.Values) int {
+	complexity := 0
+	for _, values := range query {
+		for _, value := range values {
+			complexity += strings.Count(value, ",") + 1
+		}
+	}
+	return complexity
+}
+
+var upstreamHeaders = loadUpstreamHeaders()
+
+var defaultSanityRanges = map[string][2]float64{
+	"aqhi": {0, 11},
+	"NO2":  {0, 2000},
+	"O3":   {0, 1000},
+	"SO2":  {0, 2000},
+	"CO":   {0, 100000},
+	"PM10": {0, 2000},
+	"PM25": {0, 1000},
+}
+
+var sanityRanges = loadSanityRanges()
+
+var sanityMode = loadSanityMode()
+
+func loadSanityRanges() map[string][2]float64 {
+	ranges := make(map[string][2]float64, len(defaultSanityRanges))
+	for pollutant, bounds := range defaultSanityRanges {
+		ranges[pollutant] = bounds
+	}
+
+	raw := os.Getenv("AQHI_SANITY_RANGES")
+	if raw == "" {
+		return ranges
+	}
+	var overrides map[string][2]float64
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		log.Printf("Ignoring invalid AQHI_SANITY_RANGES: %s\n", err)
+		return ranges
+	}
+	for pollutant, bounds := range overrides {
+		if bounds[0] > bounds[1] {
+			log.Printf("Ignoring inverted sanity range for %s in AQHI_SANITY_RANGES\n", pollutant)
+			continue
+		}
+		ranges[pollutant] = bounds
+	}
+	return ranges
+}
+
+func loadSanityMode() string {
+	mode := os.Getenv("AQHI_SANITY_MODE")
+	switch mode {
+	case "flag", "clamp":
+		return mode
+	case "":
+		return "flag"
+	default:
+		log.Printf("Unknown AQHI_SANITY_MODE %q, using flag\n", mode)
+		return "flag"
+	}
+}
+
+func checkSanity(measurement map[string]interface{}) {
+	var flagged []string
+	for _, pollutant := range pollutants {
+		bounds, ok := sanityRanges[pollutant]
+		if !ok {
+			continue
+		}
+		value, ok := toFloat(measurement[pollutant])
+		if !ok || (value >= bounds[0] && value <= bounds[1]) {
+			continue
+		}
+		flagged = append(flagged, pollutant)
+		if sanityMode == "clamp" {
+			measurement[pollutant] = roundPollutant(pollutant, math.Max(bounds[0], math.Min(bounds[1], value)))
+		}
+	}
+	if len(flagged) > 0 {
+		measurement["sanity_flag"] = flagged
+	}
+}
+
+func loadUpstreamHeaders() map[string]string {
+	raw := os.Getenv("UPSTREAM_HEADERS")
+	if raw == "" {
+		return nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+		log.Println("Ignoring invalid UPSTREAM_HEADERS")
+		return nil
+	}
+	return headers
+}
+
+func redactedHeaders(headers map[string]string) map[string]string {
+	redacted := make(map[string]string, len(headers))
+	for name := range headers {
+		redacted[name] = "[REDACTED]"
+	}
+	return redacted
+}
+
+func loadMaxConnections() int {
+	raw := os.Getenv("MAX_CONNECTIONS")
+	if raw == "" {
+		return 0
+	}
+	max, err := strconv.Atoi(raw)
+	if err != nil || max < 0 {
+		log.Printf("Ignoring invalid MAX_CONNECTIONS %q\n", raw)
+		return 0
+	}
+	return max
+}
+
+func loadStationMetadata() map[string]map[string]interface{} {
+	path := os.Getenv("AQHI_STATION_METADATA")
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Failed to read station metadata: %s\n", err)
+		return nil
+	}
+	var metadata map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		log.Printf("Failed to parse station metadata %s: %s\n", path, err)
+		return nil
+	}
+	normalized := make(map[string]map[string]interface{}, len(metadata))
+	for name, fields := range metadata {
+		if canonical, ok := canonicalStation(name); ok {
+			name = canonical
+		}
+		normalized[name] = fields
+	}
+	return normalized
+}
+
+func loadMaxResponseFeatures() int {
+	raw := os.Getenv("MAX_RESPONSE_FEATURES")
+	if raw == "" {
+		return 0
+	}
+	max, err := strconv.Atoi(raw)
+	if err != nil || max < 0 {
+		log.Printf("Ignoring invalid MAX_RESPONSE_FEATURES %q\n", raw)
+		return 0
+	}
+	return max
+}
+
+func loadErrorDetail() string {
+	detail := os.Getenv("ERROR_DETAIL")
+	switch detail {
+	case "full", "minimal":
+		return detail
+	case "":
+		return "full"
+	default:
+		log.Printf("Unknown ERROR_DETAIL %q, using full\n", detail)
+		return "full"
+	}
+}
+
+func loadResponseHeaders() map[string]string {
+	raw := os.Getenv("RESPONSE_HEADERS")
+	if raw == "" {
+		return nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+		log.Printf("Ignoring invalid RESPONSE_HEADERS: %s\n", err)
+		return nil
+	}
+	return headers
+}
+
+var corsOrigin = loadCORSOrigin()
+
+func loadCORSOrigin() string {
+	if origin := os.Getenv("AQHI_CORS_ORIGIN"); origin != "" {
+		return origin
+	}
+	return "*"
+}
+
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", corsOrigin)
+		if corsOrigin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Accept-Encoding, Content-Type, X-Request-Deadline")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func withResponseHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range responseHeaders {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func parseRequestDeadline(r *http.Request) (time.Time, bool, error) {
+	raw := strings.TrimSpace(r.Header.Get("X-Request-Deadline"))
+	if raw == "" {
+		return time.Time{}, false, nil
+	}
+	if deadline, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return deadline, true, nil
+	}
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid X-Request-Deadline %q", raw)
+}
+
+func withRequestDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok, err := parseRequestDeadline(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_deadline", err.Error())
+			return
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !time.Now().Before(deadline) {
+			writeError(w, http.StatusServiceUnavailable, "deadline_exceeded", "Request deadline exceeded.")
+			return
+		}
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+var errUnknownStation = errors.New("unknown station")
+
+var errDataStale = errors.New("data too old")
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writer *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	w.Header().Del("Content-Length")
+	return w.writer.Write(data)
+}
+
+func withGzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := gzip.NewWriter(w)
+		defer writer.Close()
+		next(&gzipResponseWriter{ResponseWriter: w, writer: writer}, r)
+	}
+}
+
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func withETag(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buffered := &bufferedResponseWriter{ResponseWriter: w}
+		next(buffered, r)
+		if buffered.status == 0 {
+			buffered.status = http.StatusOK
+		}
+
+		if buffered.status == http.StatusOK {
+			sum := sha256.Sum256(buffered.body.Bytes())
+			etag := fmt.Sprintf(`"%x"`, sum[:16])
+			w.Header().Set("ETag", etag)
+			if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+				w.Header().Del("Content-Type")
+				w.Header().Del("Content-Encoding")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.WriteHeader(buffered.status)
+		w.Write(buffered.body.Bytes())
+	}
+}
+
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": errorResponse{Code: code, Message: message}})
+}
+
+func classifyError(ctx context.Context, err error) (int, errorResponse) {
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return http.StatusServiceUnavailable, errorResponse{Code: "deadline_exceeded", Message: "Request deadline exceeded."}
+	case errors.Is(err, errUnknownStation):
+		return http.StatusBadRequest, errorResponse{Code: "unknown_station", Message: err.Error()}
+	case errors.Is(err, errDataStale):
+		return http.StatusServiceUnavailable, errorResponse{Code: "data_stale", Message: err.Error()}
+	case errors.Is(err, errUpstreamTimeout):
+		return http.StatusGatewayTimeout, errorResponse{Code: "upstream_timeout", Message: errorMessage(err, "Upstream request timed out.")}
+	default:
+		return http.StatusBadGateway, errorResponse{Code: "upstream_unavailable", Message: errorMessage(err, "Failed to retrieve data.")}
+	}
+}
+
+func errorMessage(err error, generic string) string {
+	if errorDetail == "minimal" {
+		log.Printf("%s %s\n", generic, err)
+		return generic
+	}
+	return err.Error()
+}
+
+func loadResampleFill() string {
+	fill := os.Getenv("AQHI_RESAMPLE_FILL")
+	switch fill {
+	case "carry", "interpolate":
+		return fill
+	case "":
+		return "carry"
+	default:
+		log.Printf("Unknown AQHI_RESAMPLE_FILL %q, using carry\n", fill)
+		return "carry"
+	}
+}
+
+const cacheFilePrefix = "aqhi_cache_"
+
+var webhookURL = os.Getenv("AQHI_WEBHOOK_URL")
+
+var webhookThreshold = loadWebhookThreshold()
+
+var (
+	elevatedStations   = make(map[string]bool)
+	elevatedStationsMu sync.Mutex
+)
+
+func loadWebhookThreshold() float64 {
+	raw := os.Getenv("AQHI_WEBHOOK_THRESHOLD")
+	if raw == "" {
+		return 7
+	}
+	threshold, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Printf("Ignoring invalid AQHI_WEBHOOK_THRESHOLD %q\n", raw)
+		return 7
+	}
+	return threshold
+}
+
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if raw := os.Getenv("AQHI_PROXY_URL"); raw != "" {
+		proxyURL, err := url.Parse(raw)
+		if err != nil || proxyURL.Host == "" {
+			log.Println("Ignoring invalid AQHI_PROXY_URL")
+		} else {
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: httpTimeout}
+}
+
+var httpTimeout = loadHTTPTimeout()
+
+var errUpstreamTimeout = errors.New("upstream request timed out")
+
+func loadHTTPTimeout() time.Duration {
+	raw := os.Getenv("AQHI_HTTP_TIMEOUT")
+	if raw == "" {
+		return 10 * time.Second
+	}
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if timeout, err := time.ParseDuration(raw); err == nil && timeout > 0 {
+		return timeout
+	}
+	log.Printf("Ignoring invalid AQHI_HTTP_TIMEOUT %q\n", raw)
+	return 10 * time.Second
+}
+
+func wrapTimeout(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %v", errUpstreamTimeout, err)
+	}
+	return err
+}
+
+var dateTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006/01/02 15:04",
+}
+
+func loadHongKongLocation() *time.Location {
+	location, err := time.LoadLocation("Asia/Hong_Kong")
+	if err != nil {
+		return time.FixedZone("HKT", 8*60*60)
+	}
+	return location
+}
+
+func parseDateTime(value interface{}) (time.Time, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	s = strings.TrimSpace(s)
+	for _, layout := range dateTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, hongKong); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func addTimestamps(measurement map[string]interface{}) {
+	measurement["DateTimeUTC"] = nil
+	measurement["timestamp"] = nil
+	if t, ok := parseDateTime(measurement["DateTime"]); ok {
+		measurement["DateTimeUTC"] = t.UTC().Format(time.RFC3339)
+		measurement["timestamp"] = t.Unix()
+	}
+}
+
+func findGaps(measurements []map[string]interface{}) []string {
+	gaps := []string{}
+	present := make(map[int64]bool)
+	var first, last time.Time
+	for _, measurement := range measurements {
+		t, ok := parseDateTime(measurement["DateTime"])
+		if !ok {
+			continue
+		}
+		t = t.Truncate(time.Hour)
+		if len(present) == 0 || t.Before(first) {
+			first = t
+		}
+		if len(present) == 0 || t.After(last) {
+			last = t
+		}
+		present[t.Unix()] = true
+	}
+	if len(present) == 0 {
+		return gaps
+	}
+
+	if windowStart := last.Add(-23 * time.Hour); first.Before(windowStart) {
+		first = windowStart
+	}
+	for t := first; !t.After(last); t = t.Add(time.Hour) {
+		if !present[t.Unix()] {
+			gaps = append(gaps, t.In(hongKong).Format(time.RFC3339))
+		}
+	}
+	return gaps
+}
+
+func loadPollutantDecimals() map[string]int {
+	decimals := make(map[string]int, len(defaultPollutantDecimals))
+	for pollutant, places := range defaultPollutantDecimals {
+		decimals[pollutant] = places
+	}
+
+	return applyDecimalOverrides(decimals, "AQHI_POLLUTANT_DECIMALS")
+}
+
+func loadCSVDecimals() map[string]int {
+	return applyDecimalOverrides(map[string]int{}, "AQHI_CSV_DECIMALS")
+}
+
+func applyDecimalOverrides(decimals map[string]int, name string) map[string]int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return decimals
+	}
+
+	var overrides map[string]int
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		log.Printf("Ignoring invalid %s: %s\n", name, err)
+		return decimals
+	}
+	for pollutant, places := range overrides {
+		if places < 0 {
+			log.Printf("Ignoring negative decimal places for %s in %s\n", pollutant, name)
+			continue
+		}
+		decimals[pollutant] = places
+	}
+	return decimals
+}
+
+func loadPollutantAliases() map[string]string {
+	raw := os.Getenv("AQHI_POLLUTANT_ALIASES")
+	if raw == "" {
+		return nil
+	}
+
+	var aliases map[string]string
+	if err := json.Unmarshal([]byte(raw), &aliases); err != nil {
+		log.Printf("Ignoring invalid AQHI_POLLUTANT_ALIASES: %s\n", err)
+		return nil
+	}
+	known := make(map[string]bool, len(pollutants))
+	for _, pollutant := range pollutants {
+		known[pollutant] = true
+	}
+	for pollutant, alias := range aliases {
+		if !known[pollutant] || alias == "" {
+			log.Printf("Ignoring alias %q for %q in AQHI_POLLUTANT_ALIASES\n", alias, pollutant)
+			delete(aliases, pollutant)
+		}
+	}
+	return aliases
+}
+
+func pollutantKey(pollutant string) string {
+	if alias, ok := pollutantAliases[pollutant]; ok {
+		return alias
+	}
+	return pollutant
+}
+
+func aliasPollutants(features []interface{}) {
+	if len(pollutantAliases) == 0 {
+		return
+	}
+	for _, feature := range features {
+		properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+		for _, measurement := range properties["feature"].([]map[string]interface{}) {
+			for pollutant, alias := range pollutantAliases {
+				if value, present := measurement[pollutant]; present {
+					delete(measurement, pollutant)
+					measurement[alias] = value
+				}
+			}
+			if flagged, ok := measurement["sanity_flag"].([]string); ok {
+				for i, pollutant := range flagged {
+					flagged[i] = pollutantKey(pollutant)
+				}
+			}
+		}
+	}
+}
+
+var aqhiCapValue = loadAQHICapValue()
+
+func loadAQHICapValue() float64 {
+	raw := os.Getenv("AQHI_CAP_VALUE")
+	if raw == "" {
+		return defaultAQHICapValue
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		log.Printf("Ignoring invalid AQHI_CAP_VALUE %q\n", raw)
+		return defaultAQHICapValue
+	}
+	return value
+}
+
+func normalizeAQHI(measurement map[string]interface{}) {
+	if s, ok := measurement["aqhi"].(string); ok && strings.TrimSpace(s) == "10+" {
+		measurement["aqhi"] = aqhiCapValue
+		measurement["capped"] = true
+		return
+	}
+	if value, ok := toFloat(measurement["aqhi"]); ok {
+		measurement["aqhi"] = value
+	}
+}
+
+type riskBand struct {
+	Max   *float64 `json:"max,omitempty"`
+	Label string   `json:"label"`
+}
+
+func bandMax(max float64) *float64 {
+	return &max
+}
+
+var defaultRiskBands = []riskBand{
+	{Max: bandMax(3), Label: "Low"},
+	{Max: bandMax(6), Label: "Moderate"},
+	{Max: bandMax(7), Label: "High"},
+	{Max: bandMax(10), Label: "Very High"},
+	{Label: "Serious"},
+}
+
+var riskBands = loadRiskBands()
+
+func loadRiskBands() []riskBand {
+	raw := os.Getenv("AQHI_RISK_BANDS")
+	if raw == "" {
+		return defaultRiskBands
+	}
+	var bands []riskBand
+	if err := json.Unmarshal([]byte(raw), &bands); err != nil {
+		log.Printf("Ignoring invalid AQHI_RISK_BANDS: %s\n", err)
+		return defaultRiskBands
+	}
+	if err := validateRiskBands(bands); err != nil {
+		log.Printf("Ignoring invalid AQHI_RISK_BANDS: %s\n", err)
+		return defaultRiskBands
+	}
+	return bands
+}
+
+func validateRiskBands(bands []riskBand) error {
+	if len(bands) == 0 {
+		return errors.New("at least one band is required")
+	}
+	for i, band := range bands {
+		if strings.TrimSpace(band.Label) == "" {
+			return fmt.Errorf("band %d has no label", i)
+		}
+		last := i == len(bands)-1
+		switch {
+		case last && band.Max != nil:
+			return errors.New("the last band must omit max so every value has a label")
+		case !last && band.Max == nil:
+			return fmt.Errorf("band %d (%s) must set max", i, band.Label)
+		case !last && (math.IsNaN(*band.Max) || math.IsInf(*band.Max, 0) || *band.Max < 0):
+			return fmt.Errorf("band %d (%s) max must be a non-negative number", i, band.Label)
+		case i > 0 && !last && *band.Max <= *bands[i-1].Max:
+			return fmt.Errorf("band %d (%s) max %v must be greater than the previous max %v", i, band.Label, *band.Max, *bands[i-1].Max)
+		}
+	}
+	return nil
+}
+
+func healthRisk(aqhi interface{}) string {
+	if s, ok := aqhi.(string); ok && strings.TrimSpace(s) == "10+" {
+		return riskBands[len(riskBands)-1].Label
+	}
+	value, ok := toFloat(aqhi)
+	if !ok || value < 0 {
+		return "Unknown"
+	}
+	for _, band := range riskBands {
+		if band.Max == nil || value <= *band.Max {
+			return band.Label
+		}
+	}
+	return "Unknown"
+}
+
+func roundPollutant(pollutant string, value interface{}) interface{} {
+	places, ok := pollutantDecimals[pollutant]
+	if !ok {
+		return value
+	}
+	f, ok := toFloat(value)
+	if !ok {
+		return value
+	}
+	scale := math.Pow(10, float64(places))
+	rounded := math.Round(f*scale) / scale
+	if _, isString := value.(string); isString {
+		return strconv.FormatFloat(rounded, 'f', places, 64)
+	}
+	return rounded
+}
+
+func cacheFilePath(key string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s%x", cacheFilePrefix, key))
+}
+
+func cacheRemaining(key string, ttl int) time.Duration {
+	info, err := os.Stat(cacheFilePath(key))
+	if err != nil {
+		return 0
+	}
+	remaining := time.Duration(ttl)*time.Second - time.Since(info.ModTime())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+type memoryCacheEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+type memoryCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+var memCache = newMemoryCache(loadMemoryCacheSize())
+
+func loadMemoryCacheSize() int {
+	raw := os.Getenv("AQHI_MEMORY_CACHE_SIZE")
+	if raw == "" {
+		return defaultMemoryCacheSize
+	}
+	size, err := strconv.Atoi(raw)
+	if err != nil || size < 0 {
+		log.Printf("Ignoring invalid AQHI_MEMORY_CACHE_SIZE %q\n", raw)
+		return defaultMemoryCacheSize
+	}
+	return size
+}
+
+func newMemoryCache(size int) *memoryCache {
+	return &memoryCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *memoryCache) get(key string) ([]byte, bool) {
+	data, _, ok := c.lookup(key, 0)
+	return data, ok
+}
+
+func (c *memoryCache) set(key string, data []byte, expires time.Time) {
+	if c.size == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value = &memoryCacheEntry{key: key, data: data, expires: expires}
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&memoryCacheEntry{key: key, data: data, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+}
+
+func (c *memoryCache) list() []memoryCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	entries := make([]memoryCacheEntry, 0, c.order.Len())
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*memoryCacheEntry)
+		if now.Before(entry.expires) {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+func (c *memoryCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+type cacheBackend interface {
+	lookup(key string, ttl time.Duration) ([]byte, time.Time, bool)
+	store(key string, data []byte, expires time.Time) error
+	listEntries() ([]map[string]interface{}, error)
+	purge() (int, error)
+}
+
+var cacheBackends = []cacheBackend{memCache, fileCache{}}
+
+func (c *memoryCache) lookup(key string, ttl time.Duration) ([]byte, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, time.Time{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry.data, entry.expires, true
+}
+
+func (c *memoryCache) store(key string, data []byte, expires time.Time) error {
+	c.set(key, data, expires)
+	return nil
+}
+
+func (c *memoryCache) listEntries() ([]map[string]interface{}, error) {
+	entries := []map[string]interface{}{}
+	for _, entry := range c.list() {
+		entries = append(entries, map[string]interface{}{
+			"backend": "memory",
+			"key":     entry.key,
+			"size":    len(entry.data),
+			"expires": entry.expires.Format(time.RFC3339),
+		})
+	}
+	return entries, nil
+}
+
+func (c *memoryCache) purge() (int, error) {
+	c.mu.Lock()
+	removed := c.order.Len()
+	c.mu.Unlock()
+	c.clear()
+	return removed, nil
+}
+
+type fileCache struct{}
+
+func (fileCache) lookup(key string, ttl time.Duration) ([]byte, time.Time, bool) {
+	cacheFile := cacheFilePath(key)
+	info, err := os.Stat(cacheFile)
+	if err != nil || time.Since(info.ModTime()) >= ttl {
+		return nil, time.Time{}, false
+	}
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	return data, info.ModTime().Add(ttl), true
+}
+
+func (fileCache) store(key string, data []byte, expires time.Time) error {
+	return writeCacheFile(cacheFilePath(key), data)
+}
+
+func (fileCache) listEntries() ([]map[string]interface{}, error) {
+	files, err := ioutil.ReadDir(os.TempDir())
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []map[string]interface{}{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, cacheFilePrefix) {
+			continue
+		}
+		key, err := hex.DecodeString(strings.TrimPrefix(name, cacheFilePrefix))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, map[string]interface{}{
+			"backend": "file",
+			"key":     string(key),
+			"size":    file.Size(),
+			"modTime": file.ModTime().Format(time.RFC3339),
+		})
+	}
+	return entries, nil
+}
+
+func (fileCache) purge() (int, error) {
+	files, err := ioutil.ReadDir(os.TempDir())
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), cacheFilePrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(os.TempDir(), file.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func getCachedData(key string, ttl int) ([]byte, bool) {
+	var missed []cacheBackend
+	for _, backend := range cacheBackends {
+		if data, expires, ok := backend.lookup(key, time.Duration(ttl)*time.Second); ok {
+			for _, faster := range missed {
+				_ = faster.store(key, data, expires)
+			}
+			return data, true
+		}
+		missed = append(missed, backend)
+	}
+	return nil, false
+}
+
+func setCachedData(key string, data []byte) {
+	expires := time.Now().Add(time.Duration(cacheTTL) * time.Second)
+	for _, backend := range cacheBackends {
+		_ = backend.store(key, data, expires)
+	}
+}
+
+func writeCacheFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+type cacheValidators struct {
+	LastModified string `json:"lastModified,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+}
+
+func getCacheValidators(key string) (cacheValidators, bool) {
+	var validators cacheValidators
+	data, err := ioutil.ReadFile(cacheFilePath(key) + ".meta")
+	if err != nil {
+		return validators, false
+	}
+	if err := json.Unmarshal(data, &validators); err != nil {
+		return validators, false
+	}
+	return validators, validators.LastModified != "" || validators.ETag != ""
+}
+
+func setCacheValidators(key string, validators cacheValidators) {
+	data, err := json.Marshal(validators)
+	if err != nil {
+		return
+	}
+	_ = writeCacheFile(cacheFilePath(key)+".meta", data)
+}
+
+var (
+	lastFetchMu    sync.Mutex
+	lastFetchTime  time.Time
+	lastFetchError error
+)
+
+func recordFetch(err error) {
+	lastFetchMu.Lock()
+	defer lastFetchMu.Unlock()
+	lastFetchTime = time.Now()
+	lastFetchError = err
+}
+
+func lastFetch() (time.Time, error) {
+	lastFetchMu.Lock()
+	defer lastFetchMu.Unlock()
+	return lastFetchTime, lastFetchError
+}
+
+var (
+	upstreamFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aqhi_upstream_fetches_total",
+		Help: "Upstream fetches by variable and result.",
+	}, []string{"variable", "result"})
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aqhi_cache_lookups_total",
+		Help: "Cache lookups by variable and result.",
+	}, []string{"variable", "result"})
+	fetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aqhi_fetch_duration_seconds",
+		Help:    "Latency of fetchAndExtractJSON, including cache hits.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"variable"})
+)
+
+var newestMeasurementUnix int64
+
+var dataAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "aqhi_data_age_seconds",
+	Help: "Seconds since the newest upstream measurement seen by the last data request.",
+}, func() float64 {
+	newest := atomic.LoadInt64(&newestMeasurementUnix)
+	if newest == 0 {
+		return math.NaN()
+	}
+	return time.Since(time.Unix(newest, 0)).Seconds()
+})
+
+func fetchAndExtractJSON(ctx context.Context, url string, variableName string, useCache bool) ([]interface{}, error) {
+	timer := prometheus.NewTimer(fetchDuration.WithLabelValues(variableName))
+	defer timer.ObserveDuration()
+
+	cacheKey := url + variableName
+	if useCache {
+		if data, ok := getCachedData(cacheKey, cacheTTL); ok {
+			var result []interface{}
+			if err := json.Unmarshal(data, &result); err == nil {
+				cacheLookups.WithLabelValues(variableName, "hit").Inc()
+				return result, nil
+			}
+		}
+		cacheLookups.WithLabelValues(variableName, "miss").Inc()
+	}
+	return fetchAndRecord(ctx, url, variableName, cacheKey)
+}
+
+func fetchLive(ctx context.Context, url string, variableName string) ([]interface{}, error) {
+	timer := prometheus.NewTimer(fetchDuration.WithLabelValues(variableName))
+	defer timer.ObserveDuration()
+	return fetchAndRecord(ctx, url, variableName, "")
+}
+
+func fetchAndRecord(ctx context.Context, url string, variableName string, cacheKey string) ([]interface{}, error) {
+	result, err := fetchUpstream(ctx, url, variableName, cacheKey)
+	if err != nil {
+		upstreamFetches.WithLabelValues(variableName, "failure").Inc()
+	} else {
+		upstreamFetches.WithLabelValues(variableName, "success").Inc()
+	}
+	if ctx.Err() == nil {
+		recordFetch(err)
+	}
+	return result, err
+}
+
+func fetchUpstream(ctx context.Context, url string, variableName string, cacheKey string) ([]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range upstreamHeaders {
+		req.Header.Set(name, value)
+	}
+
+	var cached []byte
+	cacheErr := os.ErrNotExist
+	if cacheKey != "" {
+		cached, cacheErr = ioutil.ReadFile(cacheFilePath(cacheKey))
+		validators, hasValidators := getCacheValidators(cacheKey)
+		if cacheErr == nil && hasValidators {
+			if validators.LastModified != "" {
+				req.Header.Set("If-Modified-Since", validators.LastModified)
+			}
+			if validators.ETag != "" {
+				req.Header.Set("If-None-Match", validators.ETag)
+			}
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, wrapTimeout(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cacheErr == nil {
+		var result []interface{}
+		if err := json.Unmarshal(cached, &result); err == nil {
+			setCachedData(cacheKey, cached)
+			return result, nil
+		}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, wrapTimeout(err)
+	}
+
+	re := regexp.MustCompile(fmt.Sprintf(`var %s = (\[.*?\]);`, regexp.QuoteMeta(variableName)))
+	match := re.FindSubmatch(body)
+	if len(match) < 2 {
+		log.Printf("Failed to find variable %s in the response body.\nResponse Body: %s\n", variableName, body)
+		return nil, fmt.Errorf("variable not found")
+	}
+
+	var result []interface{}
+	if err := json.Unmarshal(match[1], &result); err != nil {
+		log.Printf("Failed to unmarshal JSON for variable %s.\nJSON: %s\nError: %s\n", variableName, match[1], err)
+		return nil, err
+	}
+
+	if cacheKey != "" {
+		setCachedData(cacheKey, match[1])
+		setCacheValidators(cacheKey, cacheValidators{
+			LastModified: resp.Header.Get("Last-Modified"),
+			ETag:         resp.Header.Get("ETag"),
+		})
+	}
+	return result, nil
+}
+
+func isQualityField(name string) bool {
+	lower := strings.ToLower(name)
+	if lower == "qa" || lower == "qc" || strings.HasPrefix(lower, "qa_") || strings.HasPrefix(lower, "qc_") {
+		return true
+	}
+	for _, marker := range []string{"quality", "valid", "flag"} {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func qualityFields(entry map[string]interface{}) map[string]interface{} {
+	quality := make(map[string]interface{})
+	for name, value := range entry {
+		if isQualityField(name) {
+			quality[name] = value
+		}
+	}
+	return quality
+}
+
+func latestMeasurement(measurements []map[string]interface{}) map[string]interface{} {
+	if len(measurements) == 0 {
+		return nil
+	}
+	latest := measurements[len(measurements)-1]
+	var latestTime time.Time
+	for _, measurement := range measurements {
+		if t, ok := parseDateTime(measurement["DateTime"]); ok && t.After(latestTime) {
+			latest, latestTime = measurement, t
+		}
+	}
+	return latest
+}
+
+func checkAnomalies(latestEntries map[string]map[string]interface{}) {
+	if webhookURL == "" {
+		return
+	}
+
+	stationNames := make([]string, 0, len(latestEntries))
+	for stationName := range latestEntries {
+		stationNames = append(stationNames, stationName)
+	}
+	sort.Strings(stationNames)
+
+	elevatedStationsMu.Lock()
+	defer elevatedStationsMu.Unlock()
+
+	for _, stationName := range stationNames {
+		latest := latestEntries[stationName]
+		reading := map[string]interface{}{"aqhi": latest["aqhi"]}
+		normalizeAQHI(reading)
+		aqhi, ok := toFloat(reading["aqhi"])
+		if !ok {
+			continue
+		}
+
+		if aqhi < webhookThreshold {
+			delete(elevatedStations, stationName)
+			continue
+		}
+		if elevatedStations[stationName] {
+			continue
+		}
+		elevatedStations[stationName] = true
+
+		payload := map[string]interface{}{
+			"station":   stationName,
+			"aqhi":      aqhi,
+			"DateTime":  latest["DateTime"],
+			"threshold": webhookThreshold,
+		}
+		go sendWebhook(payload)
+	}
+}
+
+func sendWebhook(payload map[string]interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode webhook payload: %s\n", err)
+		return
+	}
+	resp, err := httpClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to send webhook for station %v: %s\n", payload["station"], err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Webhook for station %v returned status %d\n", payload["station"], resp.StatusCode)
+	}
+}
+
+func parseDataOptions(query url.Values) (dataOptions, error) {
+	var options dataOptions
+	options.last, _ = strconv.ParseBool(query.Get("last"))
+	options.recent, _ = strconv.ParseBool(query.Get("recent"))
+	options.nocache, _ = strconv.ParseBool(query.Get("nocache"))
+	options.blend, _ = strconv.ParseBool(query.Get("blend"))
+
+	if raw := query.Get("stations"); raw != "" {
+		for _, name := range strings.Split(raw, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				options.stations = append(options.stations, name)
+			}
+		}
+	}
+
+	if raw := query.Get("bbox"); raw != "" {
+		parts := strings.Split(raw, ",")
+		if len(parts) != 4 {
+			return options, fmt.Errorf("invalid bbox %q, must be minLon,minLat,maxLon,maxLat", raw)
+		}
+		var bbox [4]float64
+		for i, part := range parts {
+			value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				return options, fmt.Errorf("invalid bbox %q, must be minLon,minLat,maxLon,maxLat", raw)
+			}
+			bbox[i] = value
+		}
+		if bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+			return options, fmt.Errorf("invalid bbox %q, min must not exceed max", raw)
+		}
+		options.bbox = &bbox
+	}
+
+	for name, bound := range map[string]*time.Time{"from": &options.from, "to": &options.to} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		t, err := parseTimeParam(raw)
+		if err != nil {
+			return options, fmt.Errorf("invalid %s %q, must be RFC3339 or Unix seconds", name, raw)
+		}
+		*bound = t
+	}
+	if !options.from.IsZero() && !options.to.IsZero() && options.from.After(options.to) {
+		return options, fmt.Errorf("from must not be after to")
+	}
+
+	if raw := query.Get("resample"); raw != "" {
+		interval, err := time.ParseDuration(raw)
+		if err != nil || interval < time.Minute {
+			return options, fmt.Errorf("invalid resample interval %q", raw)
+		}
+		options.resample = interval
+	}
+
+	if raw := query.Get("extrapolate"); raw != "" {
+		hours, err := strconv.Atoi(strings.TrimSuffix(raw, "h"))
+		if err != nil || hours < 1 || hours > maxExtrapolateHours {
+			return options, fmt.Errorf("invalid extrapolate %q, must be 1h to %dh", raw, maxExtrapolateHours)
+		}
+		options.extrapolate = hours
+	}
+
+	if raw := query.Get("pollutants"); raw != "" {
+		known := make(map[string]string, len(pollutants))
+		for _, pollutant := range pollutants {
+			known[strings.ToLower(pollutant)] = pollutant
+		}
+		var invalid []string
+		for _, name := range strings.Split(raw, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if pollutant, ok := known[strings.ToLower(name)]; ok {
+				options.pollutants = append(options.pollutants, pollutant)
+			} else {
+				invalid = append(invalid, name)
+			}
+		}
+		if len(invalid) > 0 {
+			return options, fmt.Errorf("unknown pollutants: %s", strings.Join(invalid, ", "))
+		}
+	}
+
+	switch smooth := query.Get("smooth"); smooth {
+	case "":
+	case "ema":
+		options.emaAlpha = 0.3
+		if raw := query.Get("alpha"); raw != "" {
+			alpha, err := strconv.ParseFloat(raw, 64)
+			if err != nil || !(alpha > 0 && alpha <= 1) {
+				return options, fmt.Errorf("invalid alpha %q, must be in (0,1]", raw)
+			}
+			options.emaAlpha = alpha
+		}
+	default:
+		return options, fmt.Errorf("unsupported smooth method %q", smooth)
+	}
+
+	for name, threshold := range map[string]**float64{"aqhi_gt": &options.aqhiGT, "pm25_gt": &options.pm25GT} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return options, fmt.Errorf("invalid %s value %q", name, raw)
+		}
+		*threshold = &value
+	}
+
+	return options, nil
+}
+
+func parseTimeParam(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func inTimeRange(value interface{}, options dataOptions) bool {
+	if options.from.IsZero() && options.to.IsZero() {
+		return true
+	}
+	t, ok := parseDateTime(value)
+	if !ok {
+		return false
+	}
+	return (options.from.IsZero() || !t.Before(options.from)) && (options.to.IsZero() || !t.After(options.to))
+}
+
+func inBBox(coords Coordinates, bbox [4]float64) bool {
+	return coords.Longitude >= bbox[0] && coords.Latitude >= bbox[1] &&
+		coords.Longitude <= bbox[2] && coords.Latitude <= bbox[3]
+}
+
+type timedMeasurement struct {
+	time        time.Time
+	measurement map[string]interface{}
+}
+
+func sortedByTime(measurements []map[string]interface{}) []timedMeasurement {
+	var timed []timedMeasurement
+	for _, measurement := range measurements {
+		if t, ok := parseDateTime(measurement["DateTime"]); ok {
+			timed = append(timed, timedMeasurement{t, measurement})
+		}
+	}
+	sort.SliceStable(timed, func(i, j int) bool { return timed[i].time.Before(timed[j].time) })
+	return timed
+}
+
+var derivedFields = []string{"risk", "sanity_flag", "capped", "quality"}
+
+func copyDerivedFields(point, source map[string]interface{}) {
+	for _, field := range derivedFields {
+		value, ok := source[field]
+		if !ok {
+			continue
+		}
+		if flagged, isFlags := value.([]string); isFlags {
+			value = append([]string(nil), flagged...)
+		}
+		point[field] = value
+	}
+}
+
+func refreshAQHIFields(measurement map[string]interface{}) {
+	delete(measurement, "capped")
+	if value, ok := toFloat(measurement["aqhi"]); ok && value >= aqhiCapValue {
+		measurement["capped"] = true
+	}
+	measurement["risk"] = healthRisk(measurement["aqhi"])
+}
+
+func mergedSanityFlags(a, b map[string]interface{}) []string {
+	var merged []string
+	for _, pollutant := range pollutants {
+		if sanityFlagged(a, pollutant) || sanityFlagged(b, pollutant) {
+			merged = append(merged, pollutant)
+		}
+	}
+	return merged
+}
+
+func smoothEMA(measurements []map[string]interface{}, alpha float64) []map[string]interface{} {
+	smoothed := make([]map[string]interface{}, len(measurements))
+	for i, measurement := range measurements {
+		copied := make(map[string]interface{}, len(measurement))
+		for key, value := range measurement {
+			copied[key] = value
+		}
+		smoothed[i] = copied
+	}
+
+	order := make([]int, 0, len(measurements))
+	for i := range measurements {
+		if _, ok := parseDateTime(measurements[i]["DateTime"]); ok {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ta, _ := parseDateTime(measurements[order[a]]["DateTime"])
+		tb, _ := parseDateTime(measurements[order[b]]["DateTime"])
+		return ta.Before(tb)
+	})
+
+	for _, pollutant := range pollutants {
+		var ema float64
+		started := false
+		for _, i := range order {
+			value, ok := toFloat(measurements[i][pollutant])
+			if !ok {
+				continue
+			}
+			if started {
+				ema = alpha*value + (1-alpha)*ema
+			} else {
+				ema, started = value, true
+			}
+			smoothed[i][pollutant] = roundPollutant(pollutant, ema)
+		}
+	}
+	for _, i := range order {
+		refreshAQHIFields(smoothed[i])
+	}
+	return smoothed
+}
+
+func extrapolateMeasurements(measurements []map[string]interface{}, hours int) []map[string]interface{} {
+	timed := sortedByTime(measurements)
+	if len(timed) > extrapolationWindow {
+		timed = timed[len(timed)-extrapolationWindow:]
+	}
+	projected := []map[string]interface{}{}
+	if len(timed) < 2 {
+		return projected
+	}
+
+	latest := timed[len(timed)-1].time
+	for step := 1; step <= hours; step++ {
+		at := latest.Add(time.Duration(step) * time.Hour)
+		projected = append(projected, map[string]interface{}{
+			"DateTime":  at.In(hongKong).Format(time.RFC3339),
+			"projected": true,
+		})
+	}
+
+	for _, pollutant := range pollutants {
+		var xs, ys []float64
+		for _, point := range timed {
+			if value, ok := toFloat(point.measurement[pollutant]); ok {
+				xs = append(xs, point.time.Sub(latest).Hours())
+				ys = append(ys, value)
+			}
+		}
+		if len(xs) < 2 {
+			continue
+		}
+
+		var meanX, meanY float64
+		for i := range xs {
+			meanX += xs[i]
+			meanY += ys[i]
+		}
+		meanX /= float64(len(xs))
+		meanY /= float64(len(ys))
+		var covariance, variance float64
+		for i := range xs {
+			covariance += (xs[i] - meanX) * (ys[i] - meanY)
+			variance += (xs[i] - meanX) * (xs[i] - meanX)
+		}
+		if variance == 0 {
+			continue
+		}
+		slope := covariance / variance
+		intercept := meanY - slope*meanX
+
+		for step, point := range projected {
+			point[pollutant] = roundPollutant(pollutant, intercept+slope*float64(step+1))
+		}
+	}
+	return projected
+}
+
+func exceeds(measurement map[string]interface{}, options dataOptions) bool {
+	if options.aqhiGT != nil {
+		if value, ok := toFloat(measurement["aqhi"]); ok && value > *options.aqhiGT {
+			return true
+		}
+	}
+	if options.pm25GT != nil {
+		if value, ok := toFloat(measurement["PM25"]); ok && value > *options.pm25GT {
+			return true
+		}
+	}
+	return false
+}
+
+func exceedanceHours(measurements []map[string]interface{}, options dataOptions) int {
+	timed := sortedByTime(measurements)
+	hours := 0
+	for i := len(timed) - 1; i >= 0; i-- {
+		if !exceeds(timed[i].measurement, options) {
+			break
+		}
+		if i < len(timed)-1 && timed[i+1].time.Sub(timed[i].time) > time.Hour {
+			break
+		}
+		hours++
+	}
+	return hours
+}
+
+func resampleMeasurements(measurements []map[string]interface{}, interval time.Duration) []map[string]interface{} {
+	snapped := sortedByTime(measurements)
+	for i := range snapped {
+		snapped[i].time = snapped[i].time.Truncate(interval)
+	}
+	resampled := []map[string]interface{}{}
+	if len(snapped) == 0 {
+		return resampled
+	}
+
+	buckets := make(map[int64]map[string]interface{})
+	for _, s := range snapped {
+		buckets[s.time.Unix()] = s.measurement
+	}
+
+	first, last := snapped[0].time, snapped[len(snapped)-1].time
+	previous := 0
+	for t := first; !t.After(last); t = t.Add(interval) {
+		for previous+1 < len(snapped) && !snapped[previous+1].time.After(t) {
+			previous++
+		}
+
+		point := map[string]interface{}{"DateTime": t.In(hongKong).Format(time.RFC3339)}
+		if measurement, ok := buckets[t.Unix()]; ok {
+			for _, pollutant := range pollutants {
+				point[pollutant] = measurement[pollutant]
+			}
+			copyDerivedFields(point, measurement)
+		} else if resampleFill == "interpolate" && previous+1 < len(snapped) {
+			before, after := snapped[previous], snapped[previous+1]
+			ratio := float64(t.Sub(before.time)) / float64(after.time.Sub(before.time))
+			for _, pollutant := range pollutants {
+				from, okFrom := toFloat(before.measurement[pollutant])
+				to, okTo := toFloat(after.measurement[pollutant])
+				if okFrom && okTo {
+					point[pollutant] = roundPollutant(pollutant, from+(to-from)*ratio)
+				} else {
+					point[pollutant] = nil
+				}
+			}
+			refreshAQHIFields(point)
+			if flagged := mergedSanityFlags(before.measurement, after.measurement); len(flagged) > 0 {
+				point["sanity_flag"] = flagged
+			}
+			point["interpolated"] = true
+		} else {
+			for _, pollutant := range pollutants {
+				point[pollutant] = snapped[previous].measurement[pollutant]
+			}
+			copyDerivedFields(point, snapped[previous].measurement)
+			point["filled"] = true
+		}
+		resampled = append(resampled, point)
+	}
+	return resampled
+}
+
+func getData(ctx context.Context, options dataOptions) (map[string]interface{}, error) {
+	last, recent := options.last, options.recent
+	data, err := fetchAndExtractJSON(ctx, pollutantURL(), pollutantVariable, !options.nocache)
+	if err != nil {
+		return nil, err
+	}
+
+	var requested map[string]bool
+	var unknownStations []string
+	if len(options.stations) > 0 {
+		requested = make(map[string]bool)
+		unknownStations = []string{}
+		for _, name := range options.stations {
+			if canonical, ok := canonicalStation(name); ok {
+				requested[canonical] = true
+			} else {
+				unknownStations = append(unknownStations, name)
+			}
+		}
+		if len(requested) == 0 {
+			return nil, fmt.Errorf("%w: %s", errUnknownStation, strings.Join(unknownStations, ", "))
+		}
+	}
+
+	stations := make(map[string]interface{})
+	upstreamEntries := 0
+	var newestUpstream time.Time
+	latestEntries := make(map[string]map[string]interface{})
+	latestTimes := make(map[string]time.Time)
+	for _, stationData := range data {
+		for _, entry := range stationData.([]interface{}) {
+			upstreamEntries++
+			entryMap := entry.(map[string]interface{})
+			stationName := entryMap["StationNameEN"].(string)
+			if canonical, ok := canonicalStation(stationName); ok {
+				stationName = canonical
+			}
+			if t, ok := parseDateTime(entryMap["DateTime"]); ok {
+				if t.After(newestUpstream) {
+					newestUpstream = t
+				}
+				if t.After(latestTimes[stationName]) {
+					latestTimes[stationName] = t
+					latestEntries[stationName] = entryMap
+				}
+			}
+			if requested != nil && !requested[stationName] {
+				continue
+			}
+			if coords, ok := coordinates[stationName]; ok {
+				if options.bbox != nil && !inBBox(coords, *options.bbox) {
+					continue
+				}
+				if !inTimeRange(entryMap["DateTime"], options) {
+					continue
+				}
+				measurement := map[string]interface{}{
+					"DateTime": entryMap["DateTime"],
+				}
+				for _, pollutant := range pollutants {
+					measurement[pollutant] = roundPollutant(pollutant, entryMap[pollutant])
+				}
+				measurement["risk"] = healthRisk(entryMap["aqhi"])
+				normalizeAQHI(measurement)
+				checkSanity(measurement)
+				if quality := qualityFields(entryMap); len(quality) > 0 {
+					measurement["quality"] = quality
+				}
+
+				feature, found := stations[stationName]
+				if !found {
+					properties := map[string]interface{}{
+						"name":    stationName,
+						"feature": []map[string]interface{}{measurement},
+					}
+					for key, value := range stationMetadata[stationName] {
+						if _, reserved := properties[key]; !reserved {
+							properties[key] = value
+						}
+					}
+					feature = map[string]interface{}{
+						"type": "Feature",
+						"geometry": map[string]interface{}{
+							"type":        "Point",
+							"coordinates": []float64{coords.Longitude, coords.Latitude},
+						},
+						"properties": properties,
+					}
+				} else {
+					feature.(map[string]interface{})["properties"].(map[string]interface{})["feature"] = append(
+						feature.(map[string]interface{})["properties"].(map[string]interface{})["feature"].([]map[string]interface{}),
+						measurement,
+					)
+				}
+				stations[stationName] = feature
+			} else {
+				logUnmappedStation(stationName)
+			}
+		}
+	}
+
+	if !newestUpstream.IsZero() {
+		atomic.StoreInt64(&newestMeasurementUnix, newestUpstream.Unix())
+	}
+	if maxDataAge > 0 && !newestUpstream.IsZero() && time.Since(newestUpstream) > maxDataAge {
+		return nil, fmt.Errorf("%w: newest measurement is from %s", errDataStale, newestUpstream.Format(time.RFC3339))
+	}
+	checkAnomalies(latestEntries)
+
+	stationNames := make([]string, 0, len(stations))
+	for stationName := range stations {
+		stationNames = append(stationNames, stationName)
+	}
+	sortStations(stationNames)
+	features := make([]interface{}, 0, len(stations))
+	for _, stationName := range stationNames {
+		features = append(features, stations[stationName])
+	}
+
+	for _, feature := range features {
+		properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+		properties["gaps"] = findGaps(properties["feature"].([]map[string]interface{}))
+	}
+
+	if options.aqhiGT != nil || options.pm25GT != nil {
+		for _, feature := range features {
+			properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+			properties["exceedanceHours"] = exceedanceHours(properties["feature"].([]map[string]interface{}), options)
+		}
+	}
+
+	if options.resample > 0 {
+		for _, feature := range features {
+			properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+			properties["feature"] = resampleMeasurements(properties["feature"].([]map[string]interface{}), options.resample)
+		}
+	}
+
+	if options.emaAlpha > 0 {
+		for _, feature := range features {
+			properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+			properties["feature"] = smoothEMA(properties["feature"].([]map[string]interface{}), options.emaAlpha)
+			properties["smoothing"] = map[string]interface{}{"method": "ema", "alpha": options.emaAlpha}
+		}
+	}
+
+	projections := make([][]map[string]interface{}, len(features))
+	if options.extrapolate > 0 {
+		for i, feature := range features {
+			properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+			projections[i] = extrapolateMeasurements(properties["feature"].([]map[string]interface{}), options.extrapolate)
+		}
+	}
+
+	result := map[string]interface{}{
+		"type":     "FeatureCollection",
+		"features": features,
+	}
+	if unknownStations != nil {
+		result["unknown_stations"] = unknownStations
+	}
+
+	if last || recent {
+		trimmed := false
+		for _, feature := range features {
+			featureMap := feature.(map[string]interface{})
+			if features, ok := featureMap["properties"].(map[string]interface{})["feature"].([]map[string]interface{}); ok && len(features) > 0 {
+				if len(features) > 1 {
+					trimmed = true
+				}
+				if last {
+					featureMap["properties"].(map[string]interface{})["feature"] = features[len(features)-1 : len(features)]
+				} else if recent {
+					featureMap["properties"].(map[string]interface{})["feature"] = features[0:1]
+				}
+			}
+		}
+		if trimmed {
+			if last {
+				markTruncated(result, "last")
+			} else {
+				markTruncated(result, "recent")
+			}
+		}
+	}
+
+	for i, projected := range projections {
+		if len(projected) == 0 {
+			continue
+		}
+		properties := features[i].(map[string]interface{})["properties"].(map[string]interface{})
+		properties["feature"] = append(properties["feature"].([]map[string]interface{}), projected...)
+	}
+
+	if options.blend {
+		blendForecast(ctx, features)
+	}
+
+	for _, feature := range features {
+		properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+		for _, measurement := range properties["feature"].([]map[string]interface{}) {
+			addTimestamps(measurement)
+		}
+	}
+
+	if len(options.pollutants) > 0 {
+		selected := make(map[string]bool, len(options.pollutants))
+		for _, pollutant := range options.pollutants {
+			selected[pollutant] = true
+		}
+		for _, feature := range features {
+			properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+			for _, measurement := range properties["feature"].([]map[string]interface{}) {
+				for _, pollutant := range pollutants {
+					if !selected[pollutant] {
+						delete(measurement, pollutant)
+					}
+				}
+				if !selected["aqhi"] {
+					delete(measurement, "risk")
+					delete(measurement, "capped")
+				}
+				if flagged, ok := measurement["sanity_flag"].([]string); ok {
+					var kept []string
+					for _, pollutant := range flagged {
+						if selected[pollutant] {
+							kept = append(kept, pollutant)
+						}
+					}
+					if len(kept) > 0 {
+						measurement["sanity_flag"] = kept
+					} else {
+						delete(measurement, "sanity_flag")
+					}
+				}
+			}
+		}
+	}
+
+	if len(features) == 0 {
+		reason := "no_match"
+		if upstreamEntries == 0 {
+			reason = "upstream_empty"
+		}
+		meta := resultMeta(result)
+		meta["empty"] = true
+		meta["reason"] = reason
+	}
+
+	return result, nil
+}
+
+func forecastByStation(ctx context.Context) (map[string][]timedMeasurement, error) {
+	data, err := fetchAndExtractJSON(ctx, forecastURL(), "aqhi_forecast", true)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []map[string]interface{}
+	for _, item := range data {
+		switch v := item.(type) {
+		case map[string]interface{}:
+			entries = append(entries, v)
+		case []interface{}:
+			for _, nested := range v {
+				if entry, ok := nested.(map[string]interface{}); ok {
+					entries = append(entries, entry)
+				}
+			}
+		}
+	}
+
+	forecasts := make(map[string][]timedMeasurement)
+	for _, entry := range entries {
+		stationName, ok := entry["StationNameEN"].(string)
+		if !ok {
+			continue
+		}
+		if canonical, ok := canonicalStation(stationName); ok {
+			stationName = canonical
+		}
+		t, ok := parseDateTime(entry["DateTime"])
+		if !ok {
+			continue
+		}
+		point := map[string]interface{}{
+			"DateTime": entry["DateTime"],
+			"aqhi":     roundPollutant("aqhi", entry["aqhi"]),
+			"risk":     healthRisk(entry["aqhi"]),
+			"forecast": true,
+		}
+		normalizeAQHI(point)
+		forecasts[stationName] = append(forecasts[stationName], timedMeasurement{t, point})
+	}
+	return forecasts, nil
+}
+
+func blendForecast(ctx context.Context, features []interface{}) {
+	forecasts, err := forecastByStation(ctx)
+	if err != nil {
+		log.Printf("Skipping forecast blending: %s\n", err)
+		return
+	}
+
+	for _, feature := range features {
+		properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+		points := forecasts[properties["name"].(string)]
+		if len(points) == 0 {
+			continue
+		}
+		measurements := properties["feature"].([]map[string]interface{})
+
+		var latest time.Time
+		if t, ok := parseDateTime(latestMeasurement(measurements)["DateTime"]); ok {
+			latest = t
+		}
+		sort.SliceStable(points, func(i, j int) bool { return points[i].time.Before(points[j].time) })
+		for _, point := range points {
+			if point.time.After(latest) {
+				measurements = append(measurements, point.measurement)
+			}
+		}
+		properties["feature"] = measurements
+	}
+}
+
+func flattenFeatures(features []interface{}) []map[string]interface{} {
+	rows := []map[string]interface{}{}
+	for _, feature := range features {
+		featureMap := feature.(map[string]interface{})
+		coordinates := featureMap["geometry"].(map[string]interface{})["coordinates"].([]float64)
+		properties := featureMap["properties"].(map[string]interface{})
+		for _, measurement := range properties["feature"].([]map[string]interface{}) {
+			row := map[string]interface{}{
+				"station":   properties["name"],
+				"longitude": coordinates[0],
+				"latitude":  coordinates[1],
+				"DateTime":  measurement["DateTime"],
+				"timestamp": nil,
+			}
+			if t, ok := parseDateTime(measurement["DateTime"]); ok {
+				row["timestamp"] = t.UTC().Format(time.RFC3339)
+			}
+			for _, pollutant := range pollutants {
+				key := pollutantKey(pollutant)
+				if _, present := measurement[key]; !present {
+					continue
+				}
+				if value, ok := toFloat(measurement[key]); ok {
+					row[key] = value
+				} else {
+					row[key] = nil
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func csvColumns(raw string) ([]string, error) {
+	columns := []string{"station", "DateTime"}
+	for _, pollutant := range pollutants {
+		columns = append(columns, pollutantKey(pollutant))
+	}
+	columns = append(columns, "longitude", "latitude")
+	if raw == "" {
+		return columns, nil
+	}
+
+	known := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		known[column] = true
+	}
+	var selected, invalid []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+		case !known[name]:
+			invalid = append(invalid, name)
+		case seen[name]:
+			return nil, fmt.Errorf("duplicate column %q", name)
+		default:
+			seen[name] = true
+			selected = append(selected, name)
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("unknown columns: %s", strings.Join(invalid, ", "))
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("columns must name at least one of: %s", strings.Join(columns, ", "))
+	}
+	return selected, nil
+}
+
+func csvUnitsComment(header []string) string {
+	units := map[string]string{"longitude": "degrees", "latitude": "degrees"}
+	for _, pollutant := range pollutants {
+		units[pollutantKey(pollutant)] = pollutantUnits[pollutant]
+	}
+	var parts []string
+	for _, column := range header {
+		if unit, ok := units[column]; ok {
+			parts = append(parts, column+"="+unit)
+		}
+	}
+	return "# units: " + strings.Join(parts, ", ")
+}
+
+func writeDataCSV(w http.ResponseWriter, features []interface{}, header []string, units bool) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="aqhi.csv"`)
+
+	if units {
+		fmt.Fprintln(w, csvUnitsComment(header))
+	}
+	columnDecimals := map[string]int{}
+	for pollutant, places := range csvDecimals {
+		columnDecimals[pollutantKey(pollutant)] = places
+	}
+	writer := csv.NewWriter(w)
+	writer.Write(header)
+	for _, row := range flattenFeatures(features) {
+		record := make([]string, len(header))
+		for i, column := range header {
+			switch value := row[column].(type) {
+			case string:
+				record[i] = value
+			case float64:
+				places, ok := columnDecimals[column]
+				if !ok {
+					places = -1
+				}
+				record[i] = strconv.FormatFloat(value, 'f', places, 64)
+			}
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Failed to write data CSV: %s\n", err)
+	}
+}
+
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func writeInfluxLines(w http.ResponseWriter, features []interface{}) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	for _, feature := range features {
+		properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+		station := influxEscaper.Replace(fmt.Sprint(properties["name"]))
+		for _, measurement := range properties["feature"].([]map[string]interface{}) {
+			t, ok := parseDateTime(measurement["DateTime"])
+			if !ok {
+				continue
+			}
+			var fields []string
+			for _, pollutant := range pollutants {
+				key := pollutantKey(pollutant)
+				if value, ok := toFloat(measurement[key]); ok {
+					fields = append(fields, influxEscaper.Replace(strings.ToLower(key))+"="+strconv.FormatFloat(value, 'f', -1, 64))
+				}
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "aqhi,station=%s %s %d\n", station, strings.Join(fields, ","), t.UnixNano())
+		}
+	}
+}
+
+func capFeatures(result map[string]interface{}, max int) {
+	features := result["features"].([]interface{})
+	if max <= 0 || len(features) <= max {
+		return
+	}
+
+	result["features"] = features[:max]
+	markTruncated(result, "max_response_features")
+}
+
+func resultMeta(result map[string]interface{}) map[string]interface{} {
+	meta, ok := result["meta"].(map[string]interface{})
+	if !ok {
+		meta = make(map[string]interface{})
+		result["meta"] = meta
+	}
+	return meta
+}
+
+func markTruncated(result map[string]interface{}, reason string) {
+	meta := resultMeta(result)
+	if existing, ok := meta["truncatedReason"].(string); ok && existing != "" {
+		reason = existing + "," + reason
+	}
+	meta["truncated"] = true
+	meta["truncatedReason"] = reason
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	var f float64
+	switch v := value.(type) {
+	case float64:
+		f = v
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, false
+		}
+		f = parsed
+	default:
+		return 0, false
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+func getExtremes(ctx context.Context, options dataOptions) (map[string]interface{}, error) {
+	data, err := getData(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	features := data["features"].([]interface{})
+
+	extremes := make(map[string]interface{})
+	for _, pollutant := range pollutants {
+		var min, max map[string]interface{}
+		for _, feature := range features {
+			properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+			stationName := properties["name"].(string)
+			for _, measurement := range properties["feature"].([]map[string]interface{}) {
+				if measurement["forecast"] == true || measurement["projected"] == true || sanityFlagged(measurement, pollutant) {
+					continue
+				}
+				value, ok := toFloat(measurement[pollutant])
+				if !ok {
+					continue
+				}
+				observation := map[string]interface{}{
+					"value":    value,
+					"station":  stationName,
+					"DateTime": measurement["DateTime"],
+				}
+				if min == nil || value < min["value"].(float64) {
+					min = observation
+				}
+				if max == nil || value > max["value"].(float64) {
+					max = observation
+				}
+			}
+		}
+		if min != nil {
+			extremes[pollutantKey(pollutant)] = map[string]interface{}{"min": min, "max": max}
 		}
 	}
-	return nil, false
+
+	return map[string]interface{}{"extremes": extremes}, nil
 }
 
-func setCachedData(key string, data []byte) {
-	cacheFile := filepath.Join(os.TempDir(), fmt.Sprintf("aqhi_cache_%x", key))
-	_ = ioutil.WriteFile(cacheFile, data, 0644)
+func parsePollutant(query url.Values) (string, error) {
+	raw := query.Get("pollutant")
+	if raw == "" {
+		return "aqhi", nil
+	}
+	for _, pollutant := range pollutants {
+		if raw == pollutant || raw == pollutantKey(pollutant) {
+			return pollutant, nil
+		}
+	}
+	return "", fmt.Errorf("unknown pollutant %q", raw)
 }
 
-func fetchAndExtractJSON(url string, variableName string) ([]interface{}, error) {
-	cacheKey := url + variableName
-	if data, ok := getCachedData(cacheKey, 300); ok {
-		var result []interface{}
-		if err := json.Unmarshal(data, &result); err == nil {
-			return result, nil
+func sanityFlagged(measurement map[string]interface{}, pollutant string) bool {
+	if sanityMode == "clamp" {
+		return false
+	}
+	flagged, _ := measurement["sanity_flag"].([]string)
+	for _, name := range flagged {
+		if name == pollutant {
+			return true
 		}
 	}
+	return false
+}
 
-	resp, err := http.Get(url)
+func getCityMean(ctx context.Context, options dataOptions, pollutant string) (map[string]interface{}, error) {
+	data, err := getData(ctx, options)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	type hourlySum struct {
+		time  time.Time
+		sum   float64
+		count int
+	}
+	hours := make(map[int64]*hourlySum)
+	for _, feature := range data["features"].([]interface{}) {
+		properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+		for _, measurement := range properties["feature"].([]map[string]interface{}) {
+			if measurement["forecast"] == true || measurement["projected"] == true || sanityFlagged(measurement, pollutant) {
+				continue
+			}
+			t, ok := parseDateTime(measurement["DateTime"])
+			if !ok {
+				continue
+			}
+			value, ok := toFloat(measurement[pollutant])
+			if !ok {
+				continue
+			}
+			hour := t.Truncate(time.Hour)
+			bucket, found := hours[hour.Unix()]
+			if !found {
+				bucket = &hourlySum{time: hour}
+				hours[hour.Unix()] = bucket
+			}
+			bucket.sum += value
+			bucket.count++
+		}
 	}
 
-	re := regexp.MustCompile(fmt.Sprintf(`var %s = (\[.+?\]);`, regexp.QuoteMeta(variableName)))
-	match := re.FindSubmatch(body)
-	if len(match) < 2 {
-		log.Printf("Failed to find variable %s in the response body.\nResponse Body: %s\n", variableName, body)
-		return nil, fmt.Errorf("variable not found")
+	buckets := make([]*hourlySum, 0, len(hours))
+	for _, bucket := range hours {
+		buckets = append(buckets, bucket)
 	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].time.Before(buckets[j].time) })
 
-	var result []interface{}
-	if err := json.Unmarshal(match[1], &result); err != nil {
-		log.Printf("Failed to unmarshal JSON for variable %s.\nJSON: %s\nError: %s\n", variableName, match[1], err)
+	series := make([]map[string]interface{}, 0, len(buckets))
+	for _, bucket := range buckets {
+		series = append(series, map[string]interface{}{
+			"DateTime": bucket.time.In(hongKong).Format(time.RFC3339),
+			"mean":     roundPollutant(pollutant, bucket.sum/float64(bucket.count)),
+			"stations": bucket.count,
+		})
+	}
+	return map[string]interface{}{
+		"pollutant": pollutantKey(pollutant),
+		"series":    series,
+	}, nil
+}
+
+func getCityIndex(ctx context.Context, options dataOptions, weighting string) (map[string]interface{}, error) {
+	data, err := getData(ctx, options)
+	if err != nil {
 		return nil, err
 	}
 
-	setCachedData(cacheKey, match[1])
+	contributions := []map[string]interface{}{}
+	weightedSum, totalWeight := 0.0, 0.0
+	for _, feature := range data["features"].([]interface{}) {
+		properties := feature.(map[string]interface{})["properties"].(map[string]interface{})
+		measurements := properties["feature"].([]map[string]interface{})
+
+		var latest time.Time
+		var latestAQHI float64
+		observed, valid := 0, 0
+		for _, measurement := range measurements {
+			if measurement["forecast"] == true || measurement["projected"] == true {
+				continue
+			}
+			observed++
+			t, ok := parseDateTime(measurement["DateTime"])
+			if !ok {
+				continue
+			}
+			value, ok := toFloat(measurement["aqhi"])
+			if !ok || sanityFlagged(measurement, "aqhi") {
+				continue
+			}
+			valid++
+			if t.After(latest) {
+				latest, latestAQHI = t, value
+			}
+		}
+		if valid == 0 {
+			continue
+		}
+
+		weight := 1.0
+		if weighting == "completeness" {
+			weight = float64(valid) / float64(observed)
+		}
+		weightedSum += weight * latestAQHI
+		totalWeight += weight
+		contributions = append(contributions, map[string]interface{}{
+			"name":     properties["name"],
+			"aqhi":     latestAQHI,
+			"DateTime": latest.In(hongKong).Format(time.RFC3339),
+			"weight":   math.Round(weight*1000) / 1000,
+		})
+	}
+
+	method := "mean of each station's latest valid AQHI, each station weighted by its share of hours with a valid AQHI"
+	if weighting == "count" {
+		method = "mean of each station's latest valid AQHI, every reporting station weighted equally"
+	}
+	result := map[string]interface{}{
+		"weighting": weighting,
+		"method":    method,
+		"stations":  contributions,
+		"index":     nil,
+		"risk":      "Unknown",
+	}
+	if totalWeight > 0 {
+		index := math.Round(weightedSum/totalWeight*10) / 10
+		result["index"] = index
+		result["risk"] = healthRisk(index)
+	}
 	return result, nil
 }
 
-func getData(last, recent bool) (map[string]interface{}, error) {
-	url := "https://www.aqhi.gov.hk/js/data/past_24_pollutant.js"
-	data, err := fetchAndExtractJSON(url, "station_24_data")
+func indexStationEntries(data []interface{}) map[string]map[string]interface{} {
+	entries := make(map[string]map[string]interface{})
+	for _, stationData := range data {
+		stationEntries, ok := stationData.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, entry := range stationEntries {
+			entryMap, ok := entry.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key := fmt.Sprintf("%v|%v", entryMap["StationNameEN"], entryMap["DateTime"])
+			entries[key] = entryMap
+		}
+	}
+	return entries
+}
+
+func getCacheDiff(ctx context.Context) (map[string]interface{}, error) {
+	cacheKey := pollutantURL() + pollutantVariable
+	var cached []interface{}
+	if raw, err := ioutil.ReadFile(cacheFilePath(cacheKey)); err == nil {
+		if err := json.Unmarshal(raw, &cached); err != nil {
+			return nil, err
+		}
+	}
+
+	live, err := fetchLive(ctx, pollutantURL(), pollutantVariable)
 	if err != nil {
 		return nil, err
 	}
 
-	features := make(map[string]interface{})
-	for _, stationData := range data {
-		for _, entry := range stationData.([]interface{}) {
-			entryMap := entry.(map[string]interface{})
-			stationName := entryMap["StationNameEN"].(string)
-			if coords, ok := coordinates[stationName]; ok {
-				measurement := map[string]interface{}{
-					"DateTime": entryMap["DateTime"],
-					"aqhi":     entryMap["aqhi"],
-					"NO2":      entryMap["NO2"],
-					"O3":       entryMap["O3"],
-					"SO2":      entryMap["SO2"],
-					"CO":       entryMap["CO"],
-					"PM10":     entryMap["PM10"],
-					"PM25":     entryMap["PM25"],
-				}
+	cachedEntries := indexStationEntries(cached)
+	liveEntries := indexStationEntries(live)
+	keys := make(map[string]bool)
+	for key := range cachedEntries {
+		keys[key] = true
+	}
+	for key := range liveEntries {
+		keys[key] = true
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
 
-				feature, found := features[stationName]
-				if !found {
-					feature = map[string]interface{}{
-						"type": "Feature",
-						"geometry": map[string]interface{}{
-							"type":        "Point",
-							"coordinates": []float64{coords.Longitude, coords.Latitude},
-						},
-						"properties": map[string]interface{}{
-							"name":    stationName,
-							"feature": []map[string]interface{}{measurement},
-						},
+	differences := []map[string]interface{}{}
+	for _, key := range sortedKeys {
+		cachedEntry, inCache := cachedEntries[key]
+		liveEntry, inLive := liveEntries[key]
+		entry := cachedEntry
+		if !inCache {
+			entry = liveEntry
+		}
+		difference := map[string]interface{}{
+			"station":  entry["StationNameEN"],
+			"DateTime": entry["DateTime"],
+		}
+
+		switch {
+		case !inCache:
+			difference["status"] = "added"
+		case !inLive:
+			difference["status"] = "removed"
+		default:
+			fields := make(map[string]interface{})
+			for _, pollutant := range pollutants {
+				if fmt.Sprint(cachedEntry[pollutant]) != fmt.Sprint(liveEntry[pollutant]) {
+					fields[pollutant] = map[string]interface{}{
+						"cached": cachedEntry[pollutant],
+						"live":   liveEntry[pollutant],
 					}
-				} else {
-					feature.(map[string]interface{})["properties"].(map[string]interface{})["feature"] = append(
-						feature.(map[string]interface{})["properties"].(map[string]interface{})["feature"].([]map[string]interface{}),
-						measurement,
-					)
 				}
-				features[stationName] = feature
 			}
+			if len(fields) == 0 {
+				continue
+			}
+			difference["status"] = "changed"
+			difference["fields"] = fields
 		}
+		differences = append(differences, difference)
 	}
 
-	result := map[string]interface{}{
-		"type":     "FeatureCollection",
-		"features": features,
+	return map[string]interface{}{"differences": differences}, nil
+}
+
+func sortedStationNames() []string {
+	names := make([]string, 0, len(coordinates))
+	for name := range coordinates {
+		names = append(names, name)
+	}
+	sortStations(names)
+	return names
+}
+
+var unmappedStations sync.Map
+
+func logUnmappedStation(name string) {
+	if !debugEnabled {
+		return
 	}
+	if _, seen := unmappedStations.LoadOrStore(name, true); !seen {
+		log.Printf("Upstream station %q has no entry in the coordinates map and is omitted\n", name)
+	}
+}
 
-	if last || recent {
-		for _, feature := range features {
-			featureMap := feature.(map[string]interface{})
-			if features, ok := featureMap["properties"].(map[string]interface{})["feature"].([]map[string]interface{}); ok && len(features) > 0 {
-				if last {
-					featureMap["properties"].(map[string]interface{})["feature"] = features[len(features)-1 : len(features)]
-				} else if recent {
-					featureMap["properties"].(map[string]interface{})["feature"] = features[0:1]
-				}
-			}
+func getStations() map[string]interface{} {
+	stations := []map[string]interface{}{}
+	for _, name := range sortedStationNames() {
+		stations = append(stations, map[string]interface{}{
+			"StationNameEN": name,
+			"Longitude":     coordinates[name].Longitude,
+			"Latitude":      coordinates[name].Latitude,
+		})
+	}
+	return map[string]interface{}{"stations": stations}
+}
+
+const earthRadiusKm = 6371.0
+
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+func parseLatLon(query url.Values) (float64, float64, error) {
+	lat, err := strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, fmt.Errorf("invalid lat %q: must be a number in [-90,90]", query.Get("lat"))
+	}
+	lon, err := strconv.ParseFloat(query.Get("lon"), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, fmt.Errorf("invalid lon %q: must be a number in [-180,180]", query.Get("lon"))
+	}
+	return lat, lon, nil
+}
+
+func getNearest(ctx context.Context, options dataOptions, lat, lon float64) (map[string]interface{}, error) {
+	nearest := ""
+	nearestDistance := math.Inf(1)
+	for _, name := range sortedStationNames() {
+		coords := coordinates[name]
+		if distance := haversineKm(lat, lon, coords.Latitude, coords.Longitude); distance < nearestDistance {
+			nearest, nearestDistance = name, distance
 		}
 	}
 
-	return result, nil
+	options.stations = []string{nearest}
+	data, err := getData(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	coords := coordinates[nearest]
+	measurements := []map[string]interface{}{}
+	if features := data["features"].([]interface{}); len(features) > 0 {
+		properties := features[0].(map[string]interface{})["properties"].(map[string]interface{})
+		if latest := latestMeasurement(properties["feature"].([]map[string]interface{})); latest != nil {
+			measurements = append(measurements, latest)
+		}
+	}
+	return map[string]interface{}{
+		"type": "Feature",
+		"geometry": map[string]interface{}{
+			"type":        "Point",
+			"coordinates": []float64{coords.Longitude, coords.Latitude},
+		},
+		"properties": map[string]interface{}{
+			"name":       nearest,
+			"distanceKm": math.Round(nearestDistance*1000) / 1000,
+			"feature":    measurements,
+		},
+	}, nil
+}
+
+func writeStationsCSV(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="stations.csv"`)
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"StationNameEN", "Longitude", "Latitude"})
+	for _, name := range sortedStationNames() {
+		writer.Write([]string{
+			name,
+			strconv.FormatFloat(coordinates[name].Longitude, 'f', -1, 64),
+			strconv.FormatFloat(coordinates[name].Latitude, 'f', -1, 64),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Failed to write stations CSV: %s\n", err)
+	}
 }
 
 func getAQHIReportAndForecast(w http.ResponseWriter, r *http.Request) {
-	url := "https://www.aqhi.gov.hk/js/data/forecast_aqhi.js"
-	aqhiReport, err := fetchAndExtractJSON(url, "aqhi_report")
+	aqhiReport, reportErr := fetchAndExtractJSON(r.Context(), forecastURL(), "aqhi_report", true)
 	responseData := make(map[string]interface{})
 
-	if err != nil {
-		responseData["aqhi_report"] = map[string]string{"error": "No match found for aqhi_report."}
+	if reportErr != nil {
+		_, response := classifyError(r.Context(), reportErr)
+		responseData["aqhi_report"] = map[string]interface{}{"error": response}
 	} else {
 		responseData["aqhi_report"] = aqhiReport
 	}
 
-	aqhiForecast, err := fetchAndExtractJSON(url, "aqhi_forecast")
-	if err != nil {
-		responseData["aqhi_forecast"] = map[string]string{"error": "No match found for aqhi_forecast."}
+	aqhiForecast, forecastErr := fetchAndExtractJSON(r.Context(), forecastURL(), "aqhi_forecast", true)
+	if forecastErr != nil {
+		_, response := classifyError(r.Context(), forecastErr)
+		responseData["aqhi_forecast"] = map[string]interface{}{"error": response}
 	} else {
 		responseData["aqhi_forecast"] = aqhiForecast
 	}
 
+	if reportErr != nil && forecastErr != nil {
+		status, response := classifyError(r.Context(), forecastErr)
+		writeError(w, status, response.Code, response.Message)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(responseData)
 }
@@ -188,31 +2894,341 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	dataType := r.URL.Query().Get("data_type")
-	last, _ := strconv.ParseBool(r.URL.Query().Get("last"))
-	recent, _ := strconv.ParseBool(r.URL.Query().Get("recent"))
+	if maxQueryComplexity > 0 {
+		if complexity := queryComplexity(r.URL.Query()); complexity > maxQueryComplexity {
+			writeError(w, http.StatusBadRequest, "query_too_complex",
+				fmt.Sprintf("Query complexity %d exceeds the limit of %d.", complexity, maxQueryComplexity))
+			return
+		}
+	}
+	options, err := parseDataOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
 
 	var result map[string]interface{}
-	var err error
 
 	switch dataType {
 	case "data":
-		result, err = getData(last, recent)
+		result, err = getData(r.Context(), options)
+		if err == nil {
+			capFeatures(result, maxResponseFeatures)
+			aliasPollutants(result["features"].([]interface{}))
+			format := r.URL.Query().Get("format")
+			var columns []string
+			if format == "csv" {
+				columns, err = csvColumns(r.URL.Query().Get("columns"))
+				if err != nil {
+					writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+					return
+				}
+			}
+			if options.nocache {
+				w.Header().Set("Cache-Control", "no-store")
+			} else {
+				remaining := cacheRemaining(pollutantURL()+pollutantVariable, cacheTTL)
+				w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(remaining.Seconds())))
+			}
+			switch format {
+			case "flat":
+				json.NewEncoder(w).Encode(flattenFeatures(result["features"].([]interface{})))
+				return
+			case "csv":
+				units, _ := strconv.ParseBool(r.URL.Query().Get("units"))
+				writeDataCSV(w, result["features"].([]interface{}), columns, units)
+				return
+			case "influx":
+				writeInfluxLines(w, result["features"].([]interface{}))
+				return
+			}
+		}
+	case "extremes":
+		result, err = getExtremes(r.Context(), options)
+	case "citymean":
+		pollutant, parseErr := parsePollutant(r.URL.Query())
+		if parseErr != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", parseErr.Error())
+			return
+		}
+		result, err = getCityMean(r.Context(), options, pollutant)
+	case "cityindex":
+		weighting := r.URL.Query().Get("weighting")
+		switch weighting {
+		case "":
+			weighting = "completeness"
+		case "completeness", "count":
+		default:
+			writeError(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("unsupported weighting %q, must be completeness or count", weighting))
+			return
+		}
+		result, err = getCityIndex(r.Context(), options, weighting)
+	case "nearest":
+		lat, lon, parseErr := parseLatLon(r.URL.Query())
+		if parseErr != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", parseErr.Error())
+			return
+		}
+		result, err = getNearest(r.Context(), options, lat, lon)
+		if err == nil {
+			aliasPollutants([]interface{}{result})
+		}
+	case "cachediff":
+		if !debugEnabled {
+			writeError(w, http.StatusBadRequest, "invalid_data_type", "Invalid data_type.")
+			return
+		}
+		result, err = getCacheDiff(r.Context())
+	case "stations":
+		if r.URL.Query().Get("format") == "csv" {
+			writeStationsCSV(w)
+			return
+		}
+		result = getStations()
 	case "repo":
 		getAQHIReportAndForecast(w, r)
 		return
 	default:
-		result = map[string]interface{}{"error": "Invalid data_type."}
+		writeError(w, http.StatusBadRequest, "invalid_data_type", "Invalid data_type.")
+		return
 	}
 
 	if err != nil {
-		result = map[string]interface{}{"error": err.Error()}
+		status, response := classifyError(r.Context(), err)
+		writeError(w, status, response.Code, response.Message)
+		return
 	}
 
 	json.NewEncoder(w).Encode(result)
 }
 
+func listCacheEntries() ([]map[string]interface{}, error) {
+	entries := []map[string]interface{}{}
+	for _, backend := range cacheBackends {
+		backendEntries, err := backend.listEntries()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, backendEntries...)
+	}
+	return entries, nil
+}
+
+func handleCacheDebug(w http.ResponseWriter, r *http.Request) {
+	if !debugEnabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	entries, err := listCacheEntries()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "cache_unavailable", errorMessage(err, "Failed to list cache entries."))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"entries": entries})
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	health := map[string]interface{}{"status": "ok"}
+	if fetchedAt, err := lastFetch(); !fetchedAt.IsZero() {
+		upstream := map[string]interface{}{
+			"ok":        err == nil,
+			"fetchedAt": fetchedAt.Format(time.RFC3339),
+		}
+		if err != nil {
+			upstream["error"] = errorMessage(err, "Upstream fetch failed.")
+		}
+		health["lastFetch"] = upstream
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health)
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	_, cached := getCachedData(pollutantURL()+pollutantVariable, cacheTTL)
+	fetchedAt, err := lastFetch()
+	ready := cached || (!fetchedAt.IsZero() && err == nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "unavailable", "cached": cached})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ready", "cached": cached})
+}
+
+func clearCaches() (int, error) {
+	removed := 0
+	for _, backend := range cacheBackends {
+		count, err := backend.purge()
+		removed += count
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func handleRecompute(w http.ResponseWriter, r *http.Request) {
+	if !debugEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use POST.")
+		return
+	}
+
+	removed, err := clearCaches()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "cache_unavailable", errorMessage(err, "Failed to clear cache."))
+		return
+	}
+	log.Printf("Cleared %d cache files for recompute\n", removed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"cleared": removed})
+}
+
+func limitConnections(listener net.Listener) net.Listener {
+	if maxConnections > 0 {
+		return netutil.LimitListener(listener, maxConnections)
+	}
+	return listener
+}
+
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, "unix:")
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "[REDACTED]"
+	}
+	return parsed.Redacted()
+}
+
+func effectiveConfig() map[string]interface{} {
+	webhook := ""
+	if webhookURL != "" {
+		webhook = "[REDACTED]"
+	}
+	return map[string]interface{}{
+		"upstreamBaseURL":     redactURL(upstreamBaseURL),
+		"pollutantURL":        redactURL(pollutantURL()),
+		"forecastURL":         redactURL(forecastURL()),
+		"cacheTTLSeconds":     cacheTTL,
+		"memoryCacheSize":     memCache.size,
+		"httpTimeout":         httpTimeout.String(),
+		"cacheDir":            os.TempDir(),
+		"proxyURL":            redactURL(os.Getenv("AQHI_PROXY_URL")),
+		"pollutantDecimals":   pollutantDecimals,
+		"csvDecimals":         csvDecimals,
+		"pollutantAliases":    pollutantAliases,
+		"stationAliases":      stationAliases,
+		"stationPriority":     stationPriority,
+		"resampleFill":        resampleFill,
+		"errorDetail":         errorDetail,
+		"responseHeaders":     redactedHeaders(responseHeaders),
+		"corsOrigin":          corsOrigin,
+		"maxResponseFeatures": maxResponseFeatures,
+		"stationMetadata":     os.Getenv("AQHI_STATION_METADATA"),
+		"maxQueryComplexity":  maxQueryComplexity,
+		"maxConnections":      maxConnections,
+		"maxDataAge":          maxDataAge.String(),
+		"upstreamHeaders":     redactedHeaders(upstreamHeaders),
+		"sanityRanges":        sanityRanges,
+		"sanityMode":          sanityMode,
+		"aqhiCapValue":        aqhiCapValue,
+		"riskBands":           riskBands,
+		"webhookURL":          webhook,
+		"webhookThreshold":    webhookThreshold,
+		"debug":               debugEnabled,
+	}
+}
+
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !debugEnabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(effectiveConfig())
+}
+
 func main() {
-	http.HandleFunc("/", handleRequest)
-	log.Println("Starting server on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	defaultAddr := os.Getenv("AQHI_ADDR")
+	if defaultAddr == "" {
+		defaultAddr = ":8080"
+	}
+	addr := flag.String("addr", defaultAddr, "listen address, host:port or unix:/path/to/socket (default from AQHI_ADDR)")
+	flag.Parse()
+
+	prometheus.MustRegister(upstreamFetches, cacheLookups, fetchDuration, dataAge)
+
+	listener, err := listen(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listener = limitConnections(listener)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Starting server on %s\n", *addr)
+	if err := serve(newServer(), listener, signals); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", withETag(withGzip(handleRequest)))
+	mux.HandleFunc("/debug/cache", handleCacheDebug)
+	mux.HandleFunc("/admin/recompute", handleRecompute)
+	mux.HandleFunc("/config", handleConfig)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{Handler: withResponseHeaders(withCORS(withRequestDeadline(mux)))}
+}
+
+func serve(srv *http.Server, listener net.Listener, signals <-chan os.Signal) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Graceful shutdown failed: %s\n", err)
+		return err
+	}
+	return nil
 }
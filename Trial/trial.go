@@ -1,16 +1,38 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+	"golang.org/x/net/netutil"
+	_ "modernc.org/sqlite"
 )
 
 type GeoJSONFeature struct {
 	Type       string            `json:"type"`
+	ID         string            `json:"id"`
 	Geometry   GeoJSONGeometry   `json:"geometry"`
 	Properties GeoJSONProperties `json:"properties"`
 }
@@ -21,130 +43,2054 @@ type GeoJSONGeometry struct {
 }
 
 type GeoJSONProperties struct {
-	Station        string  `json:"Automatic Weather Station"`
-	AirTemperature float64 `json:"Air Temperature"`
+	Station        string   `json:"Automatic Weather Station"`
+	AirTemperature float64  `json:"Air Temperature"`
+	RelatedIDs     []string `json:"relatedIds,omitempty"`
+	AccuracyMeters *float64 `json:"accuracyMeters,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+}
+
+var propertyKeys = map[string]bool{
+	"Automatic Weather Station": true,
+	"Air Temperature":           true,
+	"relatedIds":                true,
+	"accuracyMeters":            true,
+	"tags":                      true,
+}
+
+func unknownPropertyKeys(raw json.RawMessage) ([]string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	var unknown []string
+	for key := range fields {
+		if !propertyKeys[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+func (p *GeoJSONProperties) UnmarshalJSON(data []byte) error {
+	type plain GeoJSONProperties
+	aux := struct {
+		*plain
+		AirTemperature json.RawMessage `json:"Air Temperature"`
+	}{plain: (*plain)(p)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if len(aux.AirTemperature) == 0 || string(aux.AirTemperature) == "null" {
+		return nil
+	}
+
+	var temperature float64
+	if err := json.Unmarshal(aux.AirTemperature, &temperature); err == nil {
+		p.AirTemperature = temperature
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(aux.AirTemperature, &text); err != nil {
+		return fmt.Errorf("Air Temperature must be a number or numeric string")
+	}
+	temperature, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil || math.IsNaN(temperature) || math.IsInf(temperature, 0) {
+		return fmt.Errorf("Air Temperature %q is not a number", text)
+	}
+	p.AirTemperature = temperature
+	return nil
 }
 
 type GeoJSONFeatureCollection struct {
-	Type     string           `json:"type"`
+	Type     string          `json:"type"`
+	Features []interface{}   `json:"features"`
+	Meta     *CollectionMeta `json:"meta,omitempty"`
+}
+
+type CollectionMeta struct {
+	Total           int    `json:"total"`
+	Offset          int    `json:"offset"`
+	Limit           int    `json:"limit,omitempty"`
+	Truncated       bool   `json:"truncated"`
+	TruncatedReason string `json:"truncatedReason,omitempty"`
+}
+
+type BulkUpdateRequest struct {
+	IDs   []string        `json:"ids"`
+	Patch json.RawMessage `json:"patch"`
+}
+
+type BulkUpdateResponse struct {
+	Updated     int      `json:"updated"`
+	NotFound    int      `json:"notFound"`
+	NotFoundIDs []string `json:"notFoundIds"`
+}
+
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type ImportResponse struct {
+	Imported int           `json:"imported"`
+	Merged   int           `json:"merged"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors"`
+}
+
+type FeatureSnapshot struct {
+	Version    uint64                   `json:"version"`
+	Timestamp  time.Time                `json:"timestamp"`
+	Collection GeoJSONFeatureCollection `json:"collection"`
+}
+
+type regionGeoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *regionGeoJSON  `json:"geometry"`
+	Features    []regionGeoJSON `json:"features"`
+}
+
+type FeatureChanges struct {
+	Version  uint64        `json:"version"`
+	Reset    bool          `json:"reset,omitempty"`
+	Features []interface{} `json:"features"`
+	Deleted  []string      `json:"deleted"`
+}
+
+type AuditEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	FeatureID string    `json:"featureId"`
+}
+
+const earthRadiusMeters = 6378137.0
+
+const maxRecentAuditEntries = 100
+
+var strictContentType, _ = strconv.ParseBool(os.Getenv("STRICT_CONTENT_TYPE"))
+
+var idStrategy = loadIDStrategy()
+
+var outputPropertyAllowlist = loadPropertyAllowlist()
+
+var errorDetail = loadErrorDetail()
+
+var responseHeaders = loadResponseHeaders()
+
+var coordinatePrecision = loadCoordinatePrecision()
+
+var defaultGeometryType = loadDefaultGeometryType()
+
+var debugEnabled, _ = strconv.ParseBool(os.Getenv("DEBUG"))
+
+var maxConnections = loadMaxConnections()
+
+var regionPolygons = loadRegionPolygons()
+
+var auditFile = os.Getenv("AUDIT_FILE")
+
+var (
+	recentAuditEntries []AuditEntry
+	auditMu            sync.Mutex
+)
+
+var sequentialID uint64
+
+var storeVersion uint64
+
+var (
+	featureVersions = make(map[string]uint64)
+	deletedVersions = make(map[string]uint64)
+	historyFloor    uint64
+	versionChanged  = make(chan struct{})
+	changesMu       sync.Mutex
+)
+
+const maxChangesWait = 60 * time.Second
+
+const maxDeletedVersions = 1000
+
+var errFeatureNotFound = errors.New("feature not found")
+
+type FeatureStore interface {
+	List() ([]GeoJSONFeature, error)
+	Get(id string) (GeoJSONFeature, error)
+	Create(feature GeoJSONFeature) error
+	Update(feature GeoJSONFeature) error
+	Delete(id string) error
+}
+
+type VersionedStore interface {
+	Version() (uint64, error)
+	SetVersion(version uint64) error
+}
+
+type memoryStore struct {
+	mu       sync.RWMutex
+	features []GeoJSONFeature
+}
+
+func newMemoryStore(features ...GeoJSONFeature) *memoryStore {
+	store := &memoryStore{}
+	for _, feature := range features {
+		store.features = append(store.features, cloneFeature(feature))
+	}
+	return store
+}
+
+func cloneFeature(feature GeoJSONFeature) GeoJSONFeature {
+	if feature.Properties.RelatedIDs != nil {
+		feature.Properties.RelatedIDs = append([]string(nil), feature.Properties.RelatedIDs...)
+	}
+	if feature.Properties.AccuracyMeters != nil {
+		accuracy := *feature.Properties.AccuracyMeters
+		feature.Properties.AccuracyMeters = &accuracy
+	}
+	if feature.Properties.Tags != nil {
+		feature.Properties.Tags = append([]string(nil), feature.Properties.Tags...)
+	}
+	return feature
+}
+
+func (s *memoryStore) index(id string) int {
+	for i, feature := range s.features {
+		if feature.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) List() ([]GeoJSONFeature, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]GeoJSONFeature, len(s.features))
+	for i, feature := range s.features {
+		list[i] = cloneFeature(feature)
+	}
+	return list, nil
+}
+
+func (s *memoryStore) Get(id string) (GeoJSONFeature, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	index := s.index(id)
+	if index < 0 {
+		return GeoJSONFeature{}, errFeatureNotFound
+	}
+	return cloneFeature(s.features[index]), nil
+}
+
+func (s *memoryStore) Create(feature GeoJSONFeature) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index(feature.ID) >= 0 {
+		return fmt.Errorf("feature %q already exists", feature.ID)
+	}
+	s.features = append(s.features, cloneFeature(feature))
+	return nil
+}
+
+func (s *memoryStore) Update(feature GeoJSONFeature) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := s.index(feature.ID)
+	if index < 0 {
+		return errFeatureNotFound
+	}
+	s.features[index] = cloneFeature(feature)
+	return nil
+}
+
+func (s *memoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := s.index(id)
+	if index < 0 {
+		return errFeatureNotFound
+	}
+	s.features = append(s.features[:index], s.features[index+1:]...)
+	return nil
+}
+
+type fileStore struct {
+	*memoryStore
+	path    string
+	version uint64
+	writeMu sync.Mutex
+}
+
+type fileStoreContents struct {
+	Version  uint64           `json:"version"`
 	Features []GeoJSONFeature `json:"features"`
 }
 
-var features []GeoJSONFeature
+func openFileStore(path string, seed ...GeoJSONFeature) (*fileStore, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		store := &fileStore{memoryStore: newMemoryStore(seed...), path: path}
+		return store, store.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var contents fileStoreContents
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(data, &contents.Features)
+	} else {
+		err = json.Unmarshal(data, &contents)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &fileStore{memoryStore: newMemoryStore(contents.Features...), path: path, version: contents.Version}, nil
+}
+
+func (s *fileStore) save() error {
+	features, err := s.memoryStore.List()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(fileStoreContents{Version: s.version, Features: features}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileStore) Create(feature GeoJSONFeature) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.memoryStore.Create(feature); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *fileStore) Update(feature GeoJSONFeature) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.memoryStore.Update(feature); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *fileStore) Delete(id string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.memoryStore.Delete(id); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *fileStore) Version() (uint64, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.version, nil
+}
+
+func (s *fileStore) SetVersion(version uint64) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.version = version
+	return s.save()
+}
+
+const sqliteSchemaVersion = 2
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, bool, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, false, err
+	}
+	db.SetMaxOpenConns(1)
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, false, err
+	}
+	if version > sqliteSchemaVersion {
+		db.Close()
+		return nil, false, fmt.Errorf("database %s has schema version %d, newer than supported %d", path, version, sqliteSchemaVersion)
+	}
+	if version < 1 {
+		_, err := db.Exec(`CREATE TABLE IF NOT EXISTS features (
+			id TEXT PRIMARY KEY,
+			type TEXT NOT NULL,
+			geometry_type TEXT NOT NULL,
+			longitude REAL NOT NULL,
+			latitude REAL NOT NULL,
+			properties TEXT NOT NULL
+		)`)
+		if err != nil {
+			db.Close()
+			return nil, false, err
+		}
+	}
+	if version < 2 {
+		_, err := db.Exec(`CREATE TABLE IF NOT EXISTS store_meta (
+			key TEXT PRIMARY KEY,
+			value INTEGER NOT NULL
+		)`)
+		if err != nil {
+			db.Close()
+			return nil, false, err
+		}
+	}
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", sqliteSchemaVersion)); err != nil {
+		db.Close()
+		return nil, false, err
+	}
+	return &sqliteStore{db: db}, version == 0, nil
+}
+
+func scanFeature(row interface{ Scan(...interface{}) error }) (GeoJSONFeature, error) {
+	var feature GeoJSONFeature
+	var properties string
+	err := row.Scan(&feature.ID, &feature.Type, &feature.Geometry.Type,
+		&feature.Geometry.Coordinates[0], &feature.Geometry.Coordinates[1], &properties)
+	if err != nil {
+		return feature, err
+	}
+	if err := json.Unmarshal([]byte(properties), &feature.Properties); err != nil {
+		return feature, fmt.Errorf("feature %q has invalid stored properties: %w", feature.ID, err)
+	}
+	return feature, nil
+}
+
+func (s *sqliteStore) List() ([]GeoJSONFeature, error) {
+	rows, err := s.db.Query("SELECT id, type, geometry_type, longitude, latitude, properties FROM features ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []GeoJSONFeature{}
+	for rows.Next() {
+		feature, err := scanFeature(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, feature)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqliteStore) Get(id string) (GeoJSONFeature, error) {
+	row := s.db.QueryRow("SELECT id, type, geometry_type, longitude, latitude, properties FROM features WHERE id = ?", id)
+	feature, err := scanFeature(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return feature, errFeatureNotFound
+	}
+	return feature, err
+}
+
+func (s *sqliteStore) Create(feature GeoJSONFeature) error {
+	properties, err := json.Marshal(feature.Properties)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO features (id, type, geometry_type, longitude, latitude, properties) VALUES (?, ?, ?, ?, ?, ?)",
+		feature.ID, feature.Type, feature.Geometry.Type, feature.Geometry.Coordinates[0], feature.Geometry.Coordinates[1], string(properties))
+	return err
+}
+
+func (s *sqliteStore) Update(feature GeoJSONFeature) error {
+	properties, err := json.Marshal(feature.Properties)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec("UPDATE features SET type = ?, geometry_type = ?, longitude = ?, latitude = ?, properties = ? WHERE id = ?",
+		feature.Type, feature.Geometry.Type, feature.Geometry.Coordinates[0], feature.Geometry.Coordinates[1], string(properties), feature.ID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return errFeatureNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) Delete(id string) error {
+	result, err := s.db.Exec("DELETE FROM features WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return errFeatureNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) Version() (uint64, error) {
+	var version uint64
+	err := s.db.QueryRow("SELECT value FROM store_meta WHERE key = 'version'").Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return version, err
+}
+
+func (s *sqliteStore) SetVersion(version uint64) error {
+	_, err := s.db.Exec("INSERT INTO store_meta (key, value) VALUES ('version', ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", version)
+	return err
+}
+
+type SpatialStore interface {
+	WithinBBox(bbox [4]float64) ([]GeoJSONFeature, error)
+	WithinRadius(center [2]float64, meters float64) ([]GeoJSONFeature, error)
+}
+
+type postgisStore struct {
+	db *sql.DB
+}
+
+const postgisSelect = "SELECT id, type, geometry_type, ST_X(geom), ST_Y(geom), properties::text FROM features"
+
+func openPostGISStore(databaseURL string) (*postgisStore, bool, error) {
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, false, err
+	}
+
+	var installed bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'postgis')").Scan(&installed); err != nil {
+		db.Close()
+		return nil, false, err
+	}
+	if !installed {
+		db.Close()
+		return nil, false, fmt.Errorf("the PostGIS extension is not installed in this database; run CREATE EXTENSION postgis or use another STORE_BACKEND")
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('features') IS NOT NULL").Scan(&exists); err != nil {
+		db.Close()
+		return nil, false, err
+	}
+	for _, statement := range []string{
+		`CREATE TABLE IF NOT EXISTS features (
+			seq BIGSERIAL,
+			id TEXT PRIMARY KEY,
+			type TEXT NOT NULL,
+			geometry_type TEXT NOT NULL,
+			geom geometry(Point, 4326) NOT NULL,
+			properties JSONB NOT NULL
+		)`,
+		"CREATE INDEX IF NOT EXISTS features_geom_idx ON features USING GIST (geom)",
+		"CREATE INDEX IF NOT EXISTS features_geog_idx ON features USING GIST ((geom::geography))",
+		`CREATE TABLE IF NOT EXISTS store_meta (
+			key TEXT PRIMARY KEY,
+			value BIGINT NOT NULL
+		)`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, false, err
+		}
+	}
+	return &postgisStore{db: db}, !exists, nil
+}
+
+func (s *postgisStore) query(query string, args ...interface{}) ([]GeoJSONFeature, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []GeoJSONFeature{}
+	for rows.Next() {
+		feature, err := scanFeature(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, feature)
+	}
+	return list, rows.Err()
+}
+
+func (s *postgisStore) List() ([]GeoJSONFeature, error) {
+	return s.query(postgisSelect + " ORDER BY seq")
+}
+
+func (s *postgisStore) Get(id string) (GeoJSONFeature, error) {
+	feature, err := scanFeature(s.db.QueryRow(postgisSelect+" WHERE id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return feature, errFeatureNotFound
+	}
+	return feature, err
+}
+
+func (s *postgisStore) Create(feature GeoJSONFeature) error {
+	properties, err := json.Marshal(feature.Properties)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO features (id, type, geometry_type, geom, properties) VALUES ($1, $2, $3, ST_SetSRID(ST_MakePoint($4, $5), 4326), $6)",
+		feature.ID, feature.Type, feature.Geometry.Type, feature.Geometry.Coordinates[0], feature.Geometry.Coordinates[1], string(properties))
+	return err
+}
+
+func (s *postgisStore) Update(feature GeoJSONFeature) error {
+	properties, err := json.Marshal(feature.Properties)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec("UPDATE features SET type = $1, geometry_type = $2, geom = ST_SetSRID(ST_MakePoint($3, $4), 4326), properties = $5 WHERE id = $6",
+		feature.Type, feature.Geometry.Type, feature.Geometry.Coordinates[0], feature.Geometry.Coordinates[1], string(properties), feature.ID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return errFeatureNotFound
+	}
+	return nil
+}
+
+func (s *postgisStore) Delete(id string) error {
+	result, err := s.db.Exec("DELETE FROM features WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return errFeatureNotFound
+	}
+	return nil
+}
+
+func (s *postgisStore) Version() (uint64, error) {
+	var version uint64
+	err := s.db.QueryRow("SELECT value FROM store_meta WHERE key = 'version'").Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return version, err
+}
+
+func (s *postgisStore) SetVersion(version uint64) error {
+	_, err := s.db.Exec("INSERT INTO store_meta (key, value) VALUES ('version', $1) ON CONFLICT (key) DO UPDATE SET value = excluded.value", version)
+	return err
+}
+
+func (s *postgisStore) WithinBBox(bbox [4]float64) ([]GeoJSONFeature, error) {
+	return s.query(postgisSelect+" WHERE geom && ST_MakeEnvelope($1, $2, $3, $4, 4326) ORDER BY seq",
+		bbox[0], bbox[1], bbox[2], bbox[3])
+}
+
+func (s *postgisStore) WithinRadius(center [2]float64, meters float64) ([]GeoJSONFeature, error) {
+	return s.query(postgisSelect+" WHERE ST_DWithin(geom::geography, ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography, $3) ORDER BY seq",
+		center[0], center[1], meters)
+}
+
+const meanEarthRadiusMeters = 6371000.0
+
+func distanceMeters(a, b [2]float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLat := toRadians(b[1] - a[1])
+	dLon := toRadians(b[0] - a[0])
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(a[1]))*math.Cos(toRadians(b[1]))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * meanEarthRadiusMeters * math.Asin(math.Sqrt(h))
+}
+
+func parseFloats(raw string, count int) ([]float64, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != count {
+		return nil, fmt.Errorf("expected %d comma-separated numbers, got %q", count, raw)
+	}
+	values := make([]float64, count)
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("invalid number %q in %q", part, raw)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func spatialQuery(r *http.Request) ([]GeoJSONFeature, bool, error) {
+	query := r.URL.Query()
+	if raw := query.Get("bbox"); raw != "" {
+		values, err := parseFloats(raw, 4)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid bbox: %w", err)
+		}
+		if values[0] > values[2] || values[1] > values[3] {
+			return nil, true, fmt.Errorf("invalid bbox %q, min must not exceed max", raw)
+		}
+		bbox := [4]float64{values[0], values[1], values[2], values[3]}
+		if spatial, ok := store.(SpatialStore); ok {
+			list, err := spatial.WithinBBox(bbox)
+			return list, false, err
+		}
+		list, err := store.List()
+		if err != nil {
+			return nil, false, err
+		}
+		within := []GeoJSONFeature{}
+		for _, feature := range list {
+			c := feature.Geometry.Coordinates
+			if c[0] >= bbox[0] && c[1] >= bbox[1] && c[0] <= bbox[2] && c[1] <= bbox[3] {
+				within = append(within, feature)
+			}
+		}
+		return within, false, nil
+	}
+
+	if raw := query.Get("near"); raw != "" {
+		values, err := parseFloats(raw, 2)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid near: %w", err)
+		}
+		meters, err := strconv.ParseFloat(query.Get("radius"), 64)
+		if err != nil || !(meters > 0) || math.IsInf(meters, 0) {
+			return nil, true, fmt.Errorf("invalid radius %q, must be a positive number of meters", query.Get("radius"))
+		}
+		center := [2]float64{values[0], values[1]}
+		if spatial, ok := store.(SpatialStore); ok {
+			list, err := spatial.WithinRadius(center, meters)
+			return list, false, err
+		}
+		list, err := store.List()
+		if err != nil {
+			return nil, false, err
+		}
+		within := []GeoJSONFeature{}
+		for _, feature := range list {
+			if distanceMeters(center, feature.Geometry.Coordinates) <= meters {
+				within = append(within, feature)
+			}
+		}
+		return within, false, nil
+	}
+
+	list, err := store.List()
+	return list, false, err
+}
+
+var store FeatureStore
+var featuresMu sync.RWMutex
+
+func openStore(seed ...GeoJSONFeature) (FeatureStore, error) {
+	switch backend := os.Getenv("STORE_BACKEND"); backend {
+	case "memory":
+		return newMemoryStore(seed...), nil
+	case "", "file":
+		path := os.Getenv("FEATURES_FILE")
+		if path == "" {
+			path = "features.json"
+		}
+		return openFileStore(path, seed...)
+	case "sqlite":
+		path := os.Getenv("DB_PATH")
+		if path == "" {
+			path = "features.db"
+		}
+		sqlite, created, err := openSQLiteStore(path)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			for _, feature := range seed {
+				if err := sqlite.Create(feature); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return sqlite, nil
+	case "postgis":
+		databaseURL := os.Getenv("DATABASE_URL")
+		if databaseURL == "" {
+			return nil, fmt.Errorf("STORE_BACKEND=postgis requires DATABASE_URL")
+		}
+		postgis, created, err := openPostGISStore(databaseURL)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			for _, feature := range seed {
+				if err := postgis.Create(feature); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return postgis, nil
+	default:
+		return nil, fmt.Errorf("unknown STORE_BACKEND %q", backend)
+	}
+}
+
+func resumeSequentialIDs(features []GeoJSONFeature) {
+	for _, feature := range features {
+		if id, err := strconv.ParseUint(feature.ID, 10, 64); err == nil && id > atomic.LoadUint64(&sequentialID) {
+			atomic.StoreUint64(&sequentialID, id)
+		}
+	}
+}
+
+func resumeStoreVersion() error {
+	versioned, ok := store.(VersionedStore)
+	if !ok {
+		return nil
+	}
+	version, err := versioned.Version()
+	if err != nil {
+		return err
+	}
+	changesMu.Lock()
+	defer changesMu.Unlock()
+	atomic.StoreUint64(&storeVersion, version)
+	historyFloor = version
+	return nil
+}
+
+func main() {
+	var err error
+	store, err = openStore(
+		GeoJSONFeature{
+			Type: "Feature",
+			ID:   newFeatureID(),
+			Geometry: GeoJSONGeometry{
+				Type:        "Point",
+				Coordinates: [2]float64{113.9219444, 22.3094444},
+			},
+			Properties: GeoJSONProperties{
+				Station:        "Chek Lap Kok",
+				AirTemperature: 27.3,
+			},
+		},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	existing, err := store.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+	resumeSequentialIDs(existing)
+	if err := resumeStoreVersion(); err != nil {
+		log.Fatal(err)
+	}
+
+	router := newRouter()
+
+	listener, err := net.Listen("tcp", ":1234")
+	if err != nil {
+		log.Fatal(err)
+	}
+	listener = limitConnections(listener)
+
+	log.Fatal(http.Serve(listener, withResponseHeaders(withRequestDeadline(router))))
+}
+
+func newRouter() *mux.Router {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/api/features", getFeatures).Methods("GET")
+	router.HandleFunc("/api/features/snapshot", getSnapshot).Methods("GET")
+	router.HandleFunc("/api/features/changes", getChanges).Methods("GET")
+	router.HandleFunc("/api/features/{id}", getFeature).Methods("GET")
+	router.HandleFunc("/api/features/{id}/related", getRelatedFeatures).Methods("GET")
+	router.HandleFunc("/api/features", requireJSON(createFeature)).Methods("POST")
+	router.HandleFunc("/api/features/bulkUpdate", requireJSON(bulkUpdateFeatures)).Methods("POST")
+	router.HandleFunc("/api/features/import", importFeatures).Methods("POST")
+	router.HandleFunc("/api/features/{id}", requireJSON(updateFeature)).Methods("PUT")
+	router.HandleFunc("/api/features/{id}", deleteFeature).Methods("DELETE")
+	router.HandleFunc("/audit", getAuditEntries).Methods("GET")
+	return router
+}
+
+func loadIDStrategy() string {
+	strategy := os.Getenv("ID_STRATEGY")
+	switch strategy {
+	case "uuid", "sequential":
+		return strategy
+	case "":
+		return "uuid"
+	default:
+		log.Printf("Unknown ID_STRATEGY %q, using uuid", strategy)
+		return "uuid"
+	}
+}
+
+func loadPropertyAllowlist() map[string]bool {
+	raw := os.Getenv("OUTPUT_PROPERTY_ALLOWLIST")
+	if raw == "" {
+		return nil
+	}
+	allowlist := make(map[string]bool)
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			allowlist[name] = true
+		}
+	}
+	return allowlist
+}
+
+func renderFeature(feature GeoJSONFeature) (interface{}, error) {
+	if outputPropertyAllowlist == nil {
+		return feature, nil
+	}
+
+	encoded, err := json.Marshal(feature.Properties)
+	if err != nil {
+		return nil, err
+	}
+	var properties map[string]interface{}
+	if err := json.Unmarshal(encoded, &properties); err != nil {
+		return nil, err
+	}
+	for name := range properties {
+		if !outputPropertyAllowlist[name] {
+			delete(properties, name)
+		}
+	}
+
+	return map[string]interface{}{
+		"type":       feature.Type,
+		"id":         feature.ID,
+		"geometry":   feature.Geometry,
+		"properties": properties,
+	}, nil
+}
+
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatal(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func newFeatureID() string {
+	if idStrategy == "sequential" {
+		return strconv.FormatUint(atomic.AddUint64(&sequentialID, 1), 10)
+	}
+	return newUUID()
+}
+
+func limitConnections(listener net.Listener) net.Listener {
+	if maxConnections > 0 {
+		return netutil.LimitListener(listener, maxConnections)
+	}
+	return listener
+}
+
+func loadMaxConnections() int {
+	raw := os.Getenv("MAX_CONNECTIONS")
+	if raw == "" {
+		return 0
+	}
+	max, err := strconv.Atoi(raw)
+	if err != nil || max < 0 {
+		log.Printf("Ignoring invalid MAX_CONNECTIONS %q", raw)
+		return 0
+	}
+	return max
+}
+
+func loadRegionPolygons() [][][][2]float64 {
+	path := os.Getenv("REGION_GEOJSON")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read REGION_GEOJSON: %s", err)
+	}
+	var region regionGeoJSON
+	if err := json.Unmarshal(data, &region); err != nil {
+		log.Fatalf("Failed to parse REGION_GEOJSON: %s", err)
+	}
+	polygons, err := collectPolygons(region)
+	if err != nil {
+		log.Fatalf("Invalid REGION_GEOJSON: %s", err)
+	}
+	if len(polygons) == 0 {
+		log.Fatalf("REGION_GEOJSON %s contains no polygons", path)
+	}
+	return polygons
+}
+
+func collectPolygons(region regionGeoJSON) ([][][][2]float64, error) {
+	switch region.Type {
+	case "Polygon":
+		var polygon [][][2]float64
+		if err := json.Unmarshal(region.Coordinates, &polygon); err != nil {
+			return nil, err
+		}
+		return [][][][2]float64{polygon}, nil
+	case "MultiPolygon":
+		var polygons [][][][2]float64
+		if err := json.Unmarshal(region.Coordinates, &polygons); err != nil {
+			return nil, err
+		}
+		return polygons, nil
+	case "Feature":
+		if region.Geometry == nil {
+			return nil, nil
+		}
+		return collectPolygons(*region.Geometry)
+	case "FeatureCollection":
+		var polygons [][][][2]float64
+		for _, feature := range region.Features {
+			collected, err := collectPolygons(feature)
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, collected...)
+		}
+		return polygons, nil
+	default:
+		return nil, fmt.Errorf("unsupported GeoJSON type %q", region.Type)
+	}
+}
+
+func ringContains(ring [][2]float64, point [2]float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > point[1]) != (b[1] > point[1]) &&
+			point[0] < (b[0]-a[0])*(point[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func inRegion(point [2]float64) bool {
+	if regionPolygons == nil {
+		return true
+	}
+	for _, polygon := range regionPolygons {
+		if len(polygon) == 0 || !ringContains(polygon[0], point) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if ringContains(hole, point) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+func loadDefaultGeometryType() string {
+	geometryType := os.Getenv("DEFAULT_GEOMETRY_TYPE")
+	switch geometryType {
+	case "", "Point":
+		return "Point"
+	case "none":
+		return ""
+	default:
+		log.Printf("Unknown DEFAULT_GEOMETRY_TYPE %q, using Point", geometryType)
+		return "Point"
+	}
+}
+
+func loadCoordinatePrecision() int {
+	raw := os.Getenv("COORDINATE_PRECISION")
+	if raw == "" {
+		return -1
+	}
+	precision, err := strconv.Atoi(raw)
+	if err != nil || precision < 0 {
+		log.Printf("Ignoring invalid COORDINATE_PRECISION %q", raw)
+		return -1
+	}
+	return precision
+}
+
+func roundCoordinates(geometry *GeoJSONGeometry) {
+	if coordinatePrecision < 0 {
+		return
+	}
+	scale := math.Pow(10, float64(coordinatePrecision))
+	for i, value := range geometry.Coordinates {
+		geometry.Coordinates[i] = math.Round(value*scale) / scale
+	}
+}
+
+func recordAudit(r *http.Request, action, featureID string) {
+	actor := r.Header.Get("X-Actor")
+	if actor == "" {
+		actor = "anonymous"
+	}
+	entry := AuditEntry{
+		Timestamp: time.Now().UTC(),
+		Actor:     actor,
+		Action:    action,
+		FeatureID: featureID,
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	recentAuditEntries = append(recentAuditEntries, entry)
+	if len(recentAuditEntries) > maxRecentAuditEntries {
+		recentAuditEntries = recentAuditEntries[len(recentAuditEntries)-maxRecentAuditEntries:]
+	}
+
+	if auditFile == "" {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %s", err)
+		return
+	}
+	file, err := os.OpenFile(auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open audit file: %s", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit entry: %s", err)
+	}
+}
+
+func getAuditEntries(w http.ResponseWriter, r *http.Request) {
+	if !debugEnabled {
+		http.NotFound(w, r)
+		return
+	}
 
-func main() {
-	features = []GeoJSONFeature{
-		{
-			Type: "Feature",
-			Geometry: GeoJSONGeometry{
-				Type:        "Point",
-				Coordinates: [2]float64{113.9219444, 22.3094444},
-			},
-			Properties: GeoJSONProperties{
-				Station:        "Chek Lap Kok",
-				AirTemperature: 27.3,
-			},
+	auditMu.Lock()
+	entries := append([]AuditEntry{}, recentAuditEntries...)
+	auditMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func toWebMercator(coordinates [2]float64) [2]float64 {
+	lon := coordinates[0] * math.Pi / 180
+	lat := coordinates[1] * math.Pi / 180
+	return [2]float64{
+		earthRadiusMeters * lon,
+		earthRadiusMeters * math.Log(math.Tan(math.Pi/4+lat/2)),
+	}
+}
+
+func projectFeature(feature GeoJSONFeature, crs string) (GeoJSONFeature, error) {
+	switch crs {
+	case "", "EPSG:4326":
+		return feature, nil
+	case "EPSG:3857":
+		feature.Geometry.Coordinates = toWebMercator(feature.Geometry.Coordinates)
+		return feature, nil
+	default:
+		return feature, fmt.Errorf("unsupported crs %q", crs)
+	}
+}
+
+func loadErrorDetail() string {
+	detail := os.Getenv("ERROR_DETAIL")
+	switch detail {
+	case "full", "minimal":
+		return detail
+	case "":
+		return "full"
+	default:
+		log.Printf("Unknown ERROR_DETAIL %q, using full", detail)
+		return "full"
+	}
+}
+
+func loadResponseHeaders() map[string]string {
+	raw := os.Getenv("RESPONSE_HEADERS")
+	if raw == "" {
+		return nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+		log.Printf("Ignoring invalid RESPONSE_HEADERS: %s", err)
+		return nil
+	}
+	return headers
+}
+
+func withResponseHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range responseHeaders {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func parseRequestDeadline(r *http.Request) (time.Time, bool, error) {
+	raw := strings.TrimSpace(r.Header.Get("X-Request-Deadline"))
+	if raw == "" {
+		return time.Time{}, false, nil
+	}
+	if deadline, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return deadline, true, nil
+	}
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid X-Request-Deadline %q", raw)
+}
+
+func withRequestDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok, err := parseRequestDeadline(r)
+		if err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !time.Now().Before(deadline) {
+			httpError(w, fmt.Errorf("request deadline exceeded"), http.StatusServiceUnavailable)
+			return
+		}
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func httpError(w http.ResponseWriter, err error, status int) {
+	if errorDetail == "minimal" {
+		log.Printf("%d %s: %s", status, http.StatusText(status), err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func featureNotFound(w http.ResponseWriter, id string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{
+			"code": "not_found",
+			"id":   id,
 		},
+	})
+}
+
+func requireJSON(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strictContentType {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || (mediaType != "application/json" && mediaType != "application/geo+json") {
+				httpError(w, errors.New("Content-Type must be application/json or application/geo+json"), http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		next(w, r)
 	}
+}
 
-	router := mux.NewRouter()
+type geometryInput struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
 
-	router.HandleFunc("/api/features", getFeatures).Methods("GET")
-	router.HandleFunc("/api/features/{id:[0-9]+}", getFeature).Methods("GET")
-	router.HandleFunc("/api/features", createFeature).Methods("POST")
-	router.HandleFunc("/api/features/{id:[0-9]+}", updateFeature).Methods("PUT")
-	router.HandleFunc("/api/features/{id:[0-9]+}", deleteFeature).Methods("DELETE")
+type featureInput struct {
+	GeoJSONFeature
+	Geometry *geometryInput `json:"geometry"`
+}
+
+func validateGeometry(input *geometryInput) (GeoJSONGeometry, error) {
+	if input == nil {
+		return GeoJSONGeometry{}, errors.New("geometry is required")
+	}
+	geometryType := input.Type
+	if geometryType == "" && len(input.Coordinates) == 2 {
+		geometryType = defaultGeometryType
+	}
+	if geometryType != "Point" {
+		return GeoJSONGeometry{}, fmt.Errorf("unsupported geometry type %q, only Point is supported", input.Type)
+	}
+	if len(input.Coordinates) != 2 {
+		return GeoJSONGeometry{}, fmt.Errorf("point coordinates must have exactly two numbers, got %d", len(input.Coordinates))
+	}
+	lon, lat := input.Coordinates[0], input.Coordinates[1]
+	if math.IsNaN(lon) || math.IsInf(lon, 0) || math.IsNaN(lat) || math.IsInf(lat, 0) {
+		return GeoJSONGeometry{}, errors.New("point coordinates must be finite numbers")
+	}
+	if lon < -180 || lon > 180 {
+		return GeoJSONGeometry{}, fmt.Errorf("longitude %v is out of range [-180, 180]", lon)
+	}
+	if lat < -90 || lat > 90 {
+		return GeoJSONGeometry{}, fmt.Errorf("latitude %v is out of range [-90, 90]", lat)
+	}
+	return GeoJSONGeometry{Type: "Point", Coordinates: [2]float64{lon, lat}}, nil
+}
 
-	log.Fatal(http.ListenAndServe(":1234", router))
+func validateAccuracy(properties GeoJSONProperties) error {
+	if properties.AccuracyMeters != nil && *properties.AccuracyMeters < 0 {
+		return fmt.Errorf("accuracyMeters must be non-negative, got %v", *properties.AccuracyMeters)
+	}
+	return nil
 }
 
-func getFeatures(w http.ResponseWriter, r *http.Request) {
-	collection := GeoJSONFeatureCollection{
+func validateRelatedIDs(selfID string, relatedIDs []string) error {
+	for _, relatedID := range relatedIDs {
+		if relatedID == selfID {
+			return fmt.Errorf("feature %q cannot be related to itself", relatedID)
+		}
+		if _, err := store.Get(relatedID); err != nil {
+			return fmt.Errorf("related feature %q does not exist", relatedID)
+		}
+	}
+	return nil
+}
+
+func buildFeatureCollection(r *http.Request, list []GeoJSONFeature) (GeoJSONFeatureCollection, int, error) {
+	crs := r.URL.Query().Get("crs")
+	rendered := make([]interface{}, 0, len(list))
+	for _, feature := range list {
+		feature, err := projectFeature(feature, crs)
+		if err != nil {
+			return GeoJSONFeatureCollection{}, http.StatusBadRequest, err
+		}
+		output, err := renderFeature(feature)
+		if err != nil {
+			return GeoJSONFeatureCollection{}, http.StatusInternalServerError, err
+		}
+		rendered = append(rendered, output)
+	}
+
+	return GeoJSONFeatureCollection{
 		Type:     "FeatureCollection",
-		Features: features,
+		Features: rendered,
+	}, http.StatusOK, nil
+}
+
+func paginate(query url.Values, list []GeoJSONFeature) ([]GeoJSONFeature, *CollectionMeta, error) {
+	rawLimit, rawOffset, rawPage := query.Get("limit"), query.Get("offset"), query.Get("page")
+	if rawLimit == "" && rawOffset == "" && rawPage == "" {
+		return list, nil, nil
+	}
+	if rawOffset != "" && rawPage != "" {
+		return nil, nil, errors.New("offset and page cannot be combined")
+	}
+
+	limit := 0
+	if rawLimit != "" {
+		parsed, err := strconv.Atoi(rawLimit)
+		if err != nil || parsed < 1 {
+			return nil, nil, fmt.Errorf("invalid limit %q, must be a positive integer", rawLimit)
+		}
+		limit = parsed
+	}
+	offset := 0
+	if rawOffset != "" {
+		parsed, err := strconv.Atoi(rawOffset)
+		if err != nil || parsed < 0 {
+			return nil, nil, fmt.Errorf("invalid offset %q, must be a non-negative integer", rawOffset)
+		}
+		offset = parsed
+	}
+	if rawPage != "" {
+		page, err := strconv.Atoi(rawPage)
+		if err != nil || page < 1 {
+			return nil, nil, fmt.Errorf("invalid page %q, must be a positive integer", rawPage)
+		}
+		if limit == 0 {
+			return nil, nil, errors.New("page requires limit")
+		}
+		if page-1 > (math.MaxInt-1)/limit {
+			return nil, nil, fmt.Errorf("invalid page %q, out of range", rawPage)
+		}
+		offset = (page - 1) * limit
+	}
+
+	meta := &CollectionMeta{Total: len(list), Offset: offset, Limit: limit}
+	start := offset
+	if start > len(list) {
+		start = len(list)
+	}
+	end := len(list)
+	if limit > 0 && limit < end-start {
+		end = start + limit
+	}
+	if end-start < len(list) {
+		meta.Truncated = true
+		meta.TruncatedReason = "pagination"
+	}
+	return list[start:end], meta, nil
+}
+
+func writeFeatureCollection(w http.ResponseWriter, r *http.Request, list []GeoJSONFeature) {
+	wrap := true
+	if raw := r.URL.Query().Get("wrap"); raw != "" {
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			httpError(w, fmt.Errorf("invalid wrap %q", raw), http.StatusBadRequest)
+			return
+		}
+		wrap = parsed
+	}
+
+	list, meta, err := paginate(r.URL.Query(), list)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	collection, status, err := buildFeatureCollection(r, list)
+	if err != nil {
+		httpError(w, err, status)
+		return
 	}
+	collection.Meta = meta
 	w.Header().Set("Content-Type", "application/json")
+	if !wrap {
+		json.NewEncoder(w).Encode(collection.Features)
+		return
+	}
 	json.NewEncoder(w).Encode(collection)
 }
 
+func bumpVersion(changedIDs, deletedIDs []string) {
+	changesMu.Lock()
+	defer changesMu.Unlock()
+
+	version := atomic.AddUint64(&storeVersion, 1)
+	for _, id := range changedIDs {
+		featureVersions[id] = version
+	}
+	for _, id := range deletedIDs {
+		delete(featureVersions, id)
+		deletedVersions[id] = version
+	}
+	for len(deletedVersions) > maxDeletedVersions {
+		oldestID, oldest := "", uint64(0)
+		for id, deletedAt := range deletedVersions {
+			if oldestID == "" || deletedAt < oldest {
+				oldestID, oldest = id, deletedAt
+			}
+		}
+		delete(deletedVersions, oldestID)
+		if oldest > historyFloor {
+			historyFloor = oldest
+		}
+	}
+	if versioned, ok := store.(VersionedStore); ok {
+		if err := versioned.SetVersion(version); err != nil {
+			log.Printf("Failed to persist store version %d: %s", version, err)
+		}
+	}
+	close(versionChanged)
+	versionChanged = make(chan struct{})
+}
+
+func getChanges(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+
+	wait := 30 * time.Second
+	if raw := r.URL.Query().Get("wait"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed < 0 {
+			httpError(w, fmt.Errorf("invalid wait %q", raw), http.StatusBadRequest)
+			return
+		}
+		wait = parsed
+	}
+	if wait > maxChangesWait {
+		wait = maxChangesWait
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		changesMu.Lock()
+		version := atomic.LoadUint64(&storeVersion)
+		changed := versionChanged
+		if version > since {
+			features, err := store.List()
+			if err != nil {
+				changesMu.Unlock()
+				httpError(w, err, http.StatusInternalServerError)
+				return
+			}
+			reset := since < historyFloor
+			changes := FeatureChanges{Version: version, Reset: reset, Features: []interface{}{}, Deleted: []string{}}
+			for _, feature := range features {
+				if !reset && featureVersions[feature.ID] <= since {
+					continue
+				}
+				output, err := renderFeature(feature)
+				if err != nil {
+					changesMu.Unlock()
+					httpError(w, err, http.StatusInternalServerError)
+					return
+				}
+				changes.Features = append(changes.Features, output)
+			}
+			for id, deletedAt := range deletedVersions {
+				if !reset && deletedAt > since {
+					changes.Deleted = append(changes.Deleted, id)
+				}
+			}
+			changesMu.Unlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(changes)
+			return
+		}
+		changesMu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			if r.Context().Err() == context.DeadlineExceeded {
+				httpError(w, fmt.Errorf("request deadline exceeded"), http.StatusServiceUnavailable)
+			}
+			return
+		}
+	}
+}
+
+func getSnapshot(w http.ResponseWriter, r *http.Request) {
+	featuresMu.RLock()
+	defer featuresMu.RUnlock()
+
+	version := atomic.LoadUint64(&storeVersion)
+	if raw := r.URL.Query().Get("atVersion"); raw != "" {
+		requested, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return
+		}
+		if requested != version {
+			httpError(w, fmt.Errorf("snapshot for version %d is not retained, current version is %d", requested, version), http.StatusNotFound)
+			return
+		}
+	}
+
+	features, err := store.List()
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	collection, status, err := buildFeatureCollection(r, features)
+	if err != nil {
+		httpError(w, err, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FeatureSnapshot{
+		Version:    version,
+		Timestamp:  time.Now().UTC(),
+		Collection: collection,
+	})
+}
+
+func lookupFeature(w http.ResponseWriter, id string) (GeoJSONFeature, bool) {
+	feature, err := store.Get(id)
+	if errors.Is(err, errFeatureNotFound) {
+		featureNotFound(w, id)
+		return feature, false
+	}
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return feature, false
+	}
+	return feature, true
+}
+
+func getFeatures(w http.ResponseWriter, r *http.Request) {
+	featuresMu.RLock()
+	defer featuresMu.RUnlock()
+
+	features, badRequest, err := spatialQuery(r)
+	if badRequest {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeFeatureCollection(w, r, features)
+}
+
+func getRelatedFeatures(w http.ResponseWriter, r *http.Request) {
+	featuresMu.RLock()
+	defer featuresMu.RUnlock()
+
+	params := mux.Vars(r)
+	feature, ok := lookupFeature(w, params["id"])
+	if !ok {
+		return
+	}
+
+	related := []GeoJSONFeature{}
+	for _, relatedID := range feature.Properties.RelatedIDs {
+		if relatedFeature, err := store.Get(relatedID); err == nil {
+			related = append(related, relatedFeature)
+		}
+	}
+	writeFeatureCollection(w, r, related)
+}
+
 func getFeature(w http.ResponseWriter, r *http.Request) {
+	featuresMu.RLock()
+	defer featuresMu.RUnlock()
+
 	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
+	stored, ok := lookupFeature(w, params["id"])
+	if !ok {
+		return
+	}
+
+	feature, err := projectFeature(stored, r.URL.Query().Get("crs"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	if id < 0 || id >= len(features) {
-		http.NotFound(w, r)
+	output, err := renderFeature(feature)
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(features[id])
+	json.NewEncoder(w).Encode(output)
 }
 
 func createFeature(w http.ResponseWriter, r *http.Request) {
-	var feature GeoJSONFeature
-	err := json.NewDecoder(r.Body).Decode(&feature)
+	var input featureInput
+	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	feature.Geometry = GeoJSONGeometry{
-		Type:        "Point",
-		Coordinates: [2]float64{113, 22},
+	geometry, err := validateGeometry(input.Geometry)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	feature := input.GeoJSONFeature
+	feature.Geometry = geometry
+	feature.ID = newFeatureID()
+	roundCoordinates(&feature.Geometry)
+
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+
+	if !inRegion(feature.Geometry.Coordinates) {
+		httpError(w, fmt.Errorf("coordinates %v are outside the configured region", feature.Geometry.Coordinates), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := validateRelatedIDs(feature.ID, feature.Properties.RelatedIDs); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := validateAccuracy(feature.Properties); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
 	}
 
-	features = append(features, feature)
+	if err := store.Create(feature); err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "create", feature.ID)
+	bumpVersion([]string{feature.ID}, nil)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(feature)
 }
 
 func updateFeature(w http.ResponseWriter, r *http.Request) {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+
 	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	existing, ok := lookupFeature(w, params["id"])
+	if !ok {
 		return
 	}
 
-	if id < 0 || id >= len(features) {
-		http.NotFound(w, r)
+	var updatedFeature GeoJSONFeature
+	err := json.NewDecoder(r.Body).Decode(&updatedFeature)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	var updatedFeature GeoJSONFeature
-	err = json.NewDecoder(r.Body).Decode(&updatedFeature)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	updatedFeature.ID = existing.ID
+	updatedFeature.Geometry = existing.Geometry
+	roundCoordinates(&updatedFeature.Geometry)
+
+	if !inRegion(updatedFeature.Geometry.Coordinates) {
+		httpError(w, fmt.Errorf("coordinates %v are outside the configured region", updatedFeature.Geometry.Coordinates), http.StatusUnprocessableEntity)
 		return
 	}
 
-	updatedFeature.Geometry = features[id].Geometry
+	if err := validateRelatedIDs(updatedFeature.ID, updatedFeature.Properties.RelatedIDs); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := validateAccuracy(updatedFeature.Properties); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
 
-	features[id] = updatedFeature
+	if err := store.Update(updatedFeature); err != nil {
+		if errors.Is(err, errFeatureNotFound) {
+			featureNotFound(w, updatedFeature.ID)
+			return
+		}
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "update", updatedFeature.ID)
+	bumpVersion([]string{updatedFeature.ID}, nil)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(updatedFeature)
 }
 
 func deleteFeature(w http.ResponseWriter, r *http.Request) {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+
 	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	deletedID := params["id"]
+	if err := store.Delete(deletedID); err != nil {
+		if errors.Is(err, errFeatureNotFound) {
+			featureNotFound(w, deletedID)
+			return
+		}
+		httpError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	if id < 0 || id >= len(features) {
-		http.NotFound(w, r)
+	features, err := store.List()
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
 		return
 	}
+	var unlinked []string
+	for _, feature := range features {
+		relatedIDs := feature.Properties.RelatedIDs[:0]
+		for _, relatedID := range feature.Properties.RelatedIDs {
+			if relatedID != deletedID {
+				relatedIDs = append(relatedIDs, relatedID)
+			}
+		}
+		if len(relatedIDs) == len(feature.Properties.RelatedIDs) {
+			continue
+		}
+		feature.Properties.RelatedIDs = relatedIDs
+		if err := store.Update(feature); err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		unlinked = append(unlinked, feature.ID)
+	}
 
-	features = append(features[:id], features[id+1:]...)
+	recordAudit(r, "delete", deletedID)
+	bumpVersion(unlinked, []string{deletedID})
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+var importColumns = []string{"station", "lon", "lat", "temperature"}
+
+func isImportHeader(record []string) bool {
+	if len(record) != len(importColumns) {
+		return false
+	}
+	for i, column := range importColumns {
+		if !strings.EqualFold(strings.TrimSpace(record[i]), column) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseImportRow(record []string) (GeoJSONFeature, error) {
+	if len(record) != len(importColumns) {
+		return GeoJSONFeature{}, fmt.Errorf("expected %d fields (%s), got %d", len(importColumns), strings.Join(importColumns, ","), len(record))
+	}
+	station := strings.TrimSpace(record[0])
+	if station == "" {
+		return GeoJSONFeature{}, errors.New("station is required")
+	}
+	values := make([]float64, 3)
+	for i, column := range importColumns[1:] {
+		value, err := strconv.ParseFloat(strings.TrimSpace(record[i+1]), 64)
+		if err != nil {
+			return GeoJSONFeature{}, fmt.Errorf("invalid %s %q", column, record[i+1])
+		}
+		values[i] = value
+	}
+	if math.IsNaN(values[2]) || math.IsInf(values[2], 0) {
+		return GeoJSONFeature{}, errors.New("temperature must be a finite number")
+	}
+	geometry, err := validateGeometry(&geometryInput{Type: "Point", Coordinates: values[:2]})
+	if err != nil {
+		return GeoJSONFeature{}, err
+	}
+	roundCoordinates(&geometry)
+	if !inRegion(geometry.Coordinates) {
+		return GeoJSONFeature{}, fmt.Errorf("coordinates %v are outside the configured region", geometry.Coordinates)
+	}
+	return GeoJSONFeature{
+		Type:     "Feature",
+		Geometry: geometry,
+		Properties: GeoJSONProperties{
+			Station:        station,
+			AirTemperature: values[2],
+		},
+	}, nil
+}
+
+func nearestFeature(features []GeoJSONFeature, point [2]float64, maxMeters float64) int {
+	nearest, nearestDistance := -1, math.Inf(1)
+	if maxMeters <= 0 {
+		return nearest
+	}
+	for i, feature := range features {
+		if distance := distanceMeters(point, feature.Geometry.Coordinates); distance <= maxMeters && distance < nearestDistance {
+			nearest, nearestDistance = i, distance
+		}
+	}
+	return nearest
+}
+
+func importFeatures(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "csv" {
+		httpError(w, fmt.Errorf("unsupported import format %q, only csv is supported", format), http.StatusBadRequest)
+		return
+	}
+
+	var snapMeters float64
+	if raw := r.URL.Query().Get("snapMeters"); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || !(parsed >= 0) || math.IsInf(parsed, 0) {
+			httpError(w, fmt.Errorf("invalid snapMeters %q, must be a non-negative number of meters", raw), http.StatusBadRequest)
+			return
+		}
+		snapMeters = parsed
+	}
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	response := ImportResponse{Errors: []ImportError{}}
+	var imported []GeoJSONFeature
+	first := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return
+		}
+		line, _ := reader.FieldPos(0)
+		if first {
+			first = false
+			if isImportHeader(record) {
+				continue
+			}
+		}
+		feature, err := parseImportRow(record)
+		if err != nil {
+			response.Failed++
+			response.Errors = append(response.Errors, ImportError{Line: line, Error: err.Error()})
+			continue
+		}
+		imported = append(imported, feature)
+	}
+
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+
+	var existing []GeoJSONFeature
+	if snapMeters > 0 {
+		list, err := store.List()
+		if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		existing = list
+	}
+
+	var changedIDs []string
+	for _, feature := range imported {
+		if index := nearestFeature(existing, feature.Geometry.Coordinates, snapMeters); index >= 0 {
+			merged := existing[index]
+			merged.Properties.Station = feature.Properties.Station
+			merged.Properties.AirTemperature = feature.Properties.AirTemperature
+			if err := store.Update(merged); err != nil {
+				httpError(w, err, http.StatusInternalServerError)
+				return
+			}
+			existing[index] = merged
+			recordAudit(r, "importMerge", merged.ID)
+			changedIDs = append(changedIDs, merged.ID)
+			response.Merged++
+			continue
+		}
+
+		feature.ID = newFeatureID()
+		if err := store.Create(feature); err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if snapMeters > 0 {
+			existing = append(existing, feature)
+		}
+		recordAudit(r, "import", feature.ID)
+		changedIDs = append(changedIDs, feature.ID)
+		response.Imported++
+	}
+	if len(changedIDs) > 0 {
+		bumpVersion(changedIDs, nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func bulkUpdateFeatures(w http.ResponseWriter, r *http.Request) {
+	var request BulkUpdateRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Patch) == 0 {
+		httpError(w, errors.New("patch is required"), http.StatusBadRequest)
+		return
+	}
+
+	unknown, err := unknownPropertyKeys(request.Patch)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	if len(unknown) > 0 {
+		httpError(w, fmt.Errorf("unknown properties in patch: %s", strings.Join(unknown, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	var patch GeoJSONProperties
+	if err := json.Unmarshal(request.Patch, &patch); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := validateAccuracy(patch); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+
+	response := BulkUpdateResponse{NotFoundIDs: []string{}}
+	var patched []GeoJSONFeature
+	for _, id := range request.IDs {
+		feature, err := store.Get(id)
+		if errors.Is(err, errFeatureNotFound) {
+			response.NotFound++
+			response.NotFoundIDs = append(response.NotFoundIDs, id)
+			continue
+		}
+		if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if err := validateRelatedIDs(id, patch.RelatedIDs); err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(request.Patch, &feature.Properties); err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return
+		}
+		patched = append(patched, feature)
+	}
+
+	var updatedIDs []string
+	for _, feature := range patched {
+		if err := store.Update(feature); err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, "bulkUpdate", feature.ID)
+		updatedIDs = append(updatedIDs, feature.ID)
+		response.Updated++
+	}
+	if response.Updated > 0 {
+		bumpVersion(updatedIDs, nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,95 @@
+//go:build postgis
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestPostGIS(t *testing.T) *postgisStore {
+	t.Helper()
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("trial_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	separator := " "
+	if strings.HasPrefix(databaseURL, "postgres://") || strings.HasPrefix(databaseURL, "postgresql://") {
+		separator = "?"
+		if strings.Contains(databaseURL, "?") {
+			separator = "&"
+		}
+	}
+	postgis, _, err := openPostGISStore(databaseURL + separator + "search_path=" + schema + ",public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { postgis.db.Close() })
+	return postgis
+}
+
+func TestPostGISBBoxQuery(t *testing.T) {
+	postgis := openTestPostGIS(t)
+	for _, feature := range []GeoJSONFeature{
+		station("1", "Happy Valley", 114.18, 22.27, 28.4),
+		station("2", "Sha Tin", 114.18, 22.38, 28.1),
+		station("3", "Chek Lap Kok", 113.92, 22.31, 27.3),
+	} {
+		if err := postgis.Create(feature); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		bbox [4]float64
+		ids  []string
+	}{
+		{[4]float64{114.1, 22.2, 114.3, 22.3}, []string{"1"}},
+		{[4]float64{113.8, 22.2, 114.3, 22.4}, []string{"1", "2", "3"}},
+		{[4]float64{110, 20, 110.1, 20.1}, nil},
+	}
+	for _, tt := range tests {
+		list, err := postgis.WithinBBox(tt.bbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, feature := range list {
+			ids = append(ids, feature.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tt.ids) {
+			t.Errorf("bbox %v = %v, want %v", tt.bbox, ids, tt.ids)
+		}
+	}
+
+	if list, err := postgis.WithinRadius([2]float64{114.18, 22.38}, 1000); err != nil || len(list) != 1 || list[0].ID != "2" {
+		t.Errorf("within 1km of Sha Tin = %+v, %v, want only feature 2", list, err)
+	}
+
+	useStore(t, postgis)
+	var collection struct {
+		Features []GeoJSONFeature `json:"features"`
+	}
+	recorder := serve(t, http.MethodGet, "/api/features?bbox=114.1,22.2,114.3,22.3", "")
+	decode(t, recorder, &collection)
+	if len(collection.Features) != 1 || collection.Features[0].ID != "1" {
+		t.Errorf("bbox handler = %s, want only feature 1", recorder.Body)
+	}
+}
@@ -0,0 +1,1183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func override[T any](t *testing.T, target *T, value T) {
+	t.Helper()
+	previous := *target
+	*target = value
+	t.Cleanup(func() { *target = previous })
+}
+
+func useStore(t *testing.T, s FeatureStore) {
+	t.Helper()
+	override(t, &store, s)
+	changesMu.Lock()
+	storeVersion, historyFloor = 0, 0
+	featureVersions = make(map[string]uint64)
+	deletedVersions = make(map[string]uint64)
+	changesMu.Unlock()
+}
+
+func station(id, name string, lon, lat, temperature float64) GeoJSONFeature {
+	return GeoJSONFeature{
+		Type:       "Feature",
+		ID:         id,
+		Geometry:   GeoJSONGeometry{Type: "Point", Coordinates: [2]float64{lon, lat}},
+		Properties: GeoJSONProperties{Station: name, AirTemperature: temperature},
+	}
+}
+
+func serve(t *testing.T, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func decode(t *testing.T, recorder *httptest.ResponseRecorder, target interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(recorder.Body.Bytes(), target); err != nil {
+		t.Fatalf("decoding %q: %s", recorder.Body.String(), err)
+	}
+}
+
+func TestBulkUpdateTagsSeveralFeatures(t *testing.T) {
+	useStore(t, newMemoryStore(
+		station("1", "Chek Lap Kok", 113.92, 22.31, 27.3),
+		station("2", "Sha Tin", 114.18, 22.38, 28.1),
+		station("3", "Tai Po", 114.16, 22.45, 26.4),
+	))
+
+	recorder := serve(t, http.MethodPost, "/api/features/bulkUpdate",
+		`{"ids": ["1", "3", "missing"], "patch": {"tags": ["coastal", "reviewed"]}}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	var response BulkUpdateResponse
+	decode(t, recorder, &response)
+	if response.Updated != 2 || response.NotFound != 1 || len(response.NotFoundIDs) != 1 || response.NotFoundIDs[0] != "missing" {
+		t.Errorf("response = %+v, want 2 updated and missing not found", response)
+	}
+
+	want := map[string]GeoJSONProperties{
+		"1": {Station: "Chek Lap Kok", AirTemperature: 27.3, Tags: []string{"coastal", "reviewed"}},
+		"2": {Station: "Sha Tin", AirTemperature: 28.1},
+		"3": {Station: "Tai Po", AirTemperature: 26.4, Tags: []string{"coastal", "reviewed"}},
+	}
+	for id, properties := range want {
+		var feature GeoJSONFeature
+		decode(t, serve(t, http.MethodGet, "/api/features/"+id, ""), &feature)
+		if feature.Properties.Station != properties.Station || feature.Properties.AirTemperature != properties.AirTemperature ||
+			fmt.Sprint(feature.Properties.Tags) != fmt.Sprint(properties.Tags) {
+			t.Errorf("feature %s properties = %+v, want %+v", id, feature.Properties, properties)
+		}
+	}
+
+	for _, patch := range []string{`{"tag": "coastal"}`, `{"tags": ["x"], "colour": "red"}`} {
+		recorder := serve(t, http.MethodPost, "/api/features/bulkUpdate", `{"ids": ["2"], "patch": `+patch+`}`)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("patch %s status = %d, want 400", patch, recorder.Code)
+		}
+	}
+	if feature, _ := store.Get("2"); feature.Properties.Tags != nil {
+		t.Errorf("rejected patch changed feature 2: %+v", feature.Properties)
+	}
+	if version := atomic.LoadUint64(&storeVersion); version != 1 {
+		t.Errorf("store version = %d, want only the accepted patch counted", version)
+	}
+}
+
+func TestWebMercatorProjection(t *testing.T) {
+	useStore(t, newMemoryStore(station("1", "Hong Kong Observatory", 114.1694, 22.3193, 28)))
+
+	recorder := serve(t, http.MethodGet, "/api/features/1?crs=EPSG:3857", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	var feature GeoJSONFeature
+	decode(t, recorder, &feature)
+	want := [2]float64{12709279.47, 2549904.43}
+	for i := range want {
+		if math.Abs(feature.Geometry.Coordinates[i]-want[i]) > 0.01 {
+			t.Errorf("projected coordinates = %v, want %v", feature.Geometry.Coordinates, want)
+		}
+	}
+
+	if recorder := serve(t, http.MethodGet, "/api/features/1?crs=EPSG:27700", ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("unsupported crs status = %d, want 400", recorder.Code)
+	}
+}
+
+func TestStrictContentType(t *testing.T) {
+	useStore(t, newMemoryStore())
+	override(t, &strictContentType, true)
+
+	body := `{"type": "Feature", "geometry": {"type": "Point", "coordinates": [114.17, 22.32]}, "properties": {}}`
+	tests := []struct {
+		contentType string
+		status      int
+	}{
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"", http.StatusUnsupportedMediaType},
+		{"application/json; charset=utf-8", http.StatusOK},
+		{"application/geo+json", http.StatusOK},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/api/features", strings.NewReader(body))
+		if tt.contentType != "" {
+			request.Header.Set("Content-Type", tt.contentType)
+		}
+		recorder := httptest.NewRecorder()
+		newRouter().ServeHTTP(recorder, request)
+		if recorder.Code != tt.status {
+			t.Errorf("Content-Type %q status = %d, want %d", tt.contentType, recorder.Code, tt.status)
+		}
+	}
+}
+
+func createStation(t *testing.T, name string, lon, lat float64) GeoJSONFeature {
+	t.Helper()
+	body, err := json.Marshal(map[string]interface{}{
+		"type":       "Feature",
+		"geometry":   map[string]interface{}{"type": "Point", "coordinates": []float64{lon, lat}},
+		"properties": map[string]interface{}{"Automatic Weather Station": name, "Air Temperature": 25},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := serve(t, http.MethodPost, "/api/features", string(body))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("create status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	var feature GeoJSONFeature
+	decode(t, recorder, &feature)
+	return feature
+}
+
+func TestIDStrategies(t *testing.T) {
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	tests := []struct {
+		strategy string
+		valid    func(i int, id string) bool
+	}{
+		{"uuid", func(i int, id string) bool { return uuidPattern.MatchString(id) }},
+		{"sequential", func(i int, id string) bool { return id == strconv.Itoa(42+i) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			useStore(t, newMemoryStore(station("41", "Existing", 114.17, 22.32, 25)))
+			override(t, &idStrategy, tt.strategy)
+			override(t, &sequentialID, 0)
+			existing, _ := store.List()
+			resumeSequentialIDs(existing)
+
+			seen := make(map[string]bool)
+			for i := 0; i < 20; i++ {
+				id := createStation(t, "Station", 114.17, 22.32).ID
+				if !tt.valid(i, id) {
+					t.Errorf("id %d = %q has the wrong format", i, id)
+				}
+				if seen[id] {
+					t.Errorf("id %q was issued twice", id)
+				}
+				seen[id] = true
+			}
+		})
+	}
+}
+
+func TestOutputPropertyAllowlist(t *testing.T) {
+	accuracy := 5.0
+	feature := station("1", "Sha Tin", 114.18, 22.38, 28.1)
+	feature.Properties.AccuracyMeters = &accuracy
+	useStore(t, newMemoryStore(feature))
+	override(t, &outputPropertyAllowlist, map[string]bool{"Automatic Weather Station": true, "accuracyMeters": true})
+
+	for _, target := range []string{"/api/features/1", "/api/features"} {
+		recorder := serve(t, http.MethodGet, target, "")
+		var output struct {
+			Properties map[string]interface{} `json:"properties"`
+			Features   []struct {
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"features"`
+		}
+		decode(t, recorder, &output)
+		properties := output.Properties
+		if len(output.Features) > 0 {
+			properties = output.Features[0].Properties
+		}
+		if len(properties) != 2 || properties["Automatic Weather Station"] != "Sha Tin" || properties["accuracyMeters"] != 5.0 {
+			t.Errorf("%s properties = %v, want only the station and accuracy", target, properties)
+		}
+	}
+}
+
+func TestErrorDetail(t *testing.T) {
+	useStore(t, newMemoryStore(station("1", "Sha Tin", 114.18, 22.38, 28.1)))
+	override(t, &strictContentType, true)
+
+	tests := []struct {
+		name, method, target, contentType, body string
+		status                                  int
+		detail                                  string
+	}{
+		{"invalid geometry", http.MethodPost, "/api/features", "application/json", `{"geometry": {"type": "Point", "coordinates": [1, 2, 3]}}`,
+			http.StatusBadRequest, "point coordinates must have exactly two numbers, got 3"},
+		{"content type", http.MethodPost, "/api/features", "text/plain", `{}`,
+			http.StatusUnsupportedMediaType, "Content-Type must be application/json or application/geo+json"},
+		{"import format", http.MethodPost, "/api/features/import?format=xlsx", "", "station,lon,lat,temperature\n",
+			http.StatusBadRequest, `unsupported import format "xlsx", only csv is supported`},
+		{"missing patch", http.MethodPost, "/api/features/bulkUpdate", "application/json", `{"ids": ["1"]}`,
+			http.StatusBadRequest, "patch is required"},
+	}
+	for _, mode := range []string{"full", "minimal"} {
+		override(t, &errorDetail, mode)
+		for _, tt := range tests {
+			request := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				request.Header.Set("Content-Type", tt.contentType)
+			}
+			recorder := httptest.NewRecorder()
+			newRouter().ServeHTTP(recorder, request)
+
+			want := tt.detail + "\n"
+			if mode == "minimal" {
+				want = http.StatusText(tt.status) + "\n"
+			}
+			if recorder.Code != tt.status || recorder.Body.String() != want {
+				t.Errorf("%s %s = %d %q, want %d %q", mode, tt.name, recorder.Code, recorder.Body, tt.status, want)
+			}
+		}
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	useStore(t, newMemoryStore(station("1", "Sha Tin", 114.18, 22.38, 28.1)))
+	override(t, &responseHeaders, map[string]string{"X-Service": "features"})
+	handler := withResponseHeaders(newRouter())
+
+	for _, target := range []string{"/api/features/1", "/api/features/missing"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		if header := recorder.Header().Get("X-Service"); header != "features" {
+			t.Errorf("%s X-Service = %q, want features", target, header)
+		}
+	}
+}
+
+func TestNotFoundBody(t *testing.T) {
+	useStore(t, newMemoryStore())
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		recorder := serve(t, method, "/api/features/missing", "")
+		if recorder.Code != http.StatusNotFound || recorder.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s status = %d, Content-Type %q, want 404 JSON", method, recorder.Code, recorder.Header().Get("Content-Type"))
+		}
+		if body := strings.TrimSpace(recorder.Body.String()); body != `{"error":{"code":"not_found","id":"missing"}}` {
+			t.Errorf("%s body = %s", method, body)
+		}
+	}
+}
+
+func TestCoordinatePrecision(t *testing.T) {
+	useStore(t, newMemoryStore())
+
+	tests := []struct {
+		precision int
+		want      [2]float64
+	}{
+		{-1, [2]float64{114.1693611, 22.3022305}},
+		{3, [2]float64{114.169, 22.302}},
+		{0, [2]float64{114, 22}},
+	}
+	for _, tt := range tests {
+		override(t, &coordinatePrecision, tt.precision)
+		created := createStation(t, "Observatory", 114.1693611, 22.3022305)
+		stored, err := store.Get(created.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.Geometry.Coordinates != tt.want || stored.Geometry.Coordinates != tt.want {
+			t.Errorf("precision %d: response %v, stored %v, want %v", tt.precision, created.Geometry.Coordinates, stored.Geometry.Coordinates, tt.want)
+		}
+	}
+}
+
+func TestRelatedFeatures(t *testing.T) {
+	useStore(t, newMemoryStore(
+		station("1", "Sha Tin", 114.18, 22.38, 28.1),
+		station("2", "Tai Po", 114.16, 22.45, 26.4),
+		station("3", "Tuen Mun", 113.98, 22.39, 27.9),
+	))
+
+	recorder := serve(t, http.MethodPut, "/api/features/1", `{"properties": {"Automatic Weather Station": "Sha Tin", "relatedIds": ["2", "3"]}}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("link status = %d, body %s", recorder.Code, recorder.Body)
+	}
+
+	var related GeoJSONFeatureCollection
+	decode(t, serve(t, http.MethodGet, "/api/features/1/related", ""), &related)
+	var ids []string
+	for _, feature := range related.Features {
+		ids = append(ids, feature.(map[string]interface{})["id"].(string))
+	}
+	if strings.Join(ids, ",") != "2,3" {
+		t.Errorf("related ids = %v, want 2 and 3", ids)
+	}
+
+	for _, body := range []string{
+		`{"properties": {"relatedIds": ["missing"]}}`,
+		`{"properties": {"relatedIds": ["1"]}}`,
+	} {
+		if recorder := serve(t, http.MethodPut, "/api/features/1", body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s status = %d, want 400", body, recorder.Code)
+		}
+	}
+
+	if recorder := serve(t, http.MethodDelete, "/api/features/2", ""); recorder.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d", recorder.Code)
+	}
+	feature, _ := store.Get("1")
+	if strings.Join(feature.Properties.RelatedIDs, ",") != "3" {
+		t.Errorf("related ids after deleting 2 = %v, want 3", feature.Properties.RelatedIDs)
+	}
+}
+
+func TestCreateIsAudited(t *testing.T) {
+	useStore(t, newMemoryStore())
+	override(t, &recentAuditEntries, nil)
+	override(t, &auditFile, filepath.Join(t.TempDir(), "audit.log"))
+	override(t, &debugEnabled, true)
+
+	request := httptest.NewRequest(http.MethodPost, "/api/features",
+		strings.NewReader(`{"geometry": {"type": "Point", "coordinates": [114.17, 22.32]}, "properties": {}}`))
+	request.Header.Set("X-Actor", "ops@example.com")
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, request)
+	var created GeoJSONFeature
+	decode(t, recorder, &created)
+
+	var entries []AuditEntry
+	decode(t, serve(t, http.MethodGet, "/audit", ""), &entries)
+	if len(entries) != 1 || entries[0].Actor != "ops@example.com" || entries[0].Action != "create" || entries[0].FeatureID != created.ID {
+		t.Errorf("audit entries = %+v, want one create by ops@example.com for %s", entries, created.ID)
+	}
+
+	logged, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal(logged, &entry); err != nil || entry.FeatureID != created.ID || entry.Action != "create" {
+		t.Errorf("audit file = %q, want the create entry", logged)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	override(t, &maxConnections, 1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})}
+	go server.Serve(limitConnections(listener))
+	defer server.Close()
+
+	done := make(chan error, 2)
+	fetch := func() {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Get("http://" + listener.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}
+	go fetch()
+	<-entered
+	go fetch()
+	select {
+	case <-entered:
+		t.Fatal("a second connection was served while the only slot was taken")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-entered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the queued connection was never served")
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestImportMergesNearDuplicates(t *testing.T) {
+	csv := "station,lon,lat,temperature\nSha Tin AWS,114.1801,22.3801,29.5\nTai Po,114.16,22.45,26\n"
+
+	tests := []struct {
+		query            string
+		imported, merged int
+		total            int
+	}{
+		{"?snapMeters=50", 1, 1, 2},
+		{"?snapMeters=5", 2, 0, 3},
+		{"", 2, 0, 3},
+	}
+	for _, tt := range tests {
+		useStore(t, newMemoryStore(station("1", "Sha Tin", 114.18, 22.38, 28.1)))
+		var response ImportResponse
+		decode(t, serve(t, http.MethodPost, "/api/features/import"+tt.query, csv), &response)
+		if response.Imported != tt.imported || response.Merged != tt.merged || response.Failed != 0 {
+			t.Errorf("import%s = %+v, want %d imported and %d merged", tt.query, response, tt.imported, tt.merged)
+		}
+		features, _ := store.List()
+		if len(features) != tt.total {
+			t.Errorf("import%s left %d features, want %d", tt.query, len(features), tt.total)
+		}
+		if tt.merged > 0 {
+			merged, _ := store.Get("1")
+			if merged.Properties.Station != "Sha Tin AWS" || merged.Properties.AirTemperature != 29.5 || merged.Geometry.Coordinates != [2]float64{114.18, 22.38} {
+				t.Errorf("merged feature = %+v, want the imported reading at the existing location", merged)
+			}
+		}
+	}
+}
+
+func TestSnapshotVersionSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "features.json")
+	opened, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, opened)
+	createStation(t, "Sha Tin", 114.18, 22.38)
+	createStation(t, "Tai Po", 114.16, 22.45)
+
+	var snapshot FeatureSnapshot
+	decode(t, serve(t, http.MethodGet, "/api/features/snapshot", ""), &snapshot)
+	if snapshot.Version != 2 || len(snapshot.Collection.Features) != 2 {
+		t.Fatalf("snapshot = version %d with %d features, want version 2 with 2", snapshot.Version, len(snapshot.Collection.Features))
+	}
+	if recorder := serve(t, http.MethodGet, "/api/features/snapshot?atVersion=1", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("stale atVersion status = %d, want 404", recorder.Code)
+	}
+
+	reopened, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, reopened)
+	if err := resumeStoreVersion(); err != nil {
+		t.Fatal(err)
+	}
+	decode(t, serve(t, http.MethodGet, "/api/features/snapshot?atVersion=2", ""), &snapshot)
+	if snapshot.Version != 2 || len(snapshot.Collection.Features) != 2 {
+		t.Errorf("snapshot after restart = version %d with %d features, want version 2 with 2", snapshot.Version, len(snapshot.Collection.Features))
+	}
+
+	var changes FeatureChanges
+	decode(t, serve(t, http.MethodGet, "/api/features/changes?since=1", ""), &changes)
+	if !changes.Reset || changes.Version != 2 || len(changes.Features) != 2 {
+		t.Errorf("changes since a pre-restart version = %+v, want a reset with every feature", changes)
+	}
+}
+
+func TestDeletedVersionsAreBounded(t *testing.T) {
+	useStore(t, newMemoryStore())
+	for i := 0; i < maxDeletedVersions+5; i++ {
+		bumpVersion(nil, []string{strconv.Itoa(i)})
+	}
+	changesMu.Lock()
+	retained, floor := len(deletedVersions), historyFloor
+	changesMu.Unlock()
+	if retained != maxDeletedVersions || floor != 5 {
+		t.Errorf("retained %d tombstones with history floor %d, want %d and 5", retained, floor, maxDeletedVersions)
+	}
+}
+
+func TestRegionRestriction(t *testing.T) {
+	useStore(t, newMemoryStore())
+	path := filepath.Join(t.TempDir(), "region.geojson")
+	region := `{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [[[113.8, 22.1], [114.5, 22.1], [114.5, 22.6], [113.8, 22.6], [113.8, 22.1]]]}}`
+	if err := os.WriteFile(path, []byte(region), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REGION_GEOJSON", path)
+	override(t, &regionPolygons, loadRegionPolygons())
+
+	tests := []struct {
+		name     string
+		lon, lat float64
+		status   int
+	}{
+		{"Hong Kong", 114.17, 22.32, http.StatusOK},
+		{"Taipei", 121.56, 25.03, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		body := fmt.Sprintf(`{"geometry": {"type": "Point", "coordinates": [%v, %v]}, "properties": {}}`, tt.lon, tt.lat)
+		if recorder := serve(t, http.MethodPost, "/api/features", body); recorder.Code != tt.status {
+			t.Errorf("%s status = %d, want %d", tt.name, recorder.Code, tt.status)
+		}
+	}
+	if features, _ := store.List(); len(features) != 1 {
+		t.Errorf("store has %d features, want only the in-region one", len(features))
+	}
+}
+
+func TestAirTemperatureCoercion(t *testing.T) {
+	tests := []struct {
+		input       string
+		temperature float64
+		err         bool
+	}{
+		{`27.5`, 27.5, false},
+		{`"27.5"`, 27.5, false},
+		{`" -3 "`, -3, false},
+		{`null`, 0, false},
+		{`"warm"`, 0, true},
+		{`"NaN"`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, tt := range tests {
+		var properties GeoJSONProperties
+		err := json.Unmarshal([]byte(`{"Automatic Weather Station": "Sha Tin", "Air Temperature": `+tt.input+`}`), &properties)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error = %v, want error %v", tt.input, err, tt.err)
+			continue
+		}
+		if !tt.err && (properties.AirTemperature != tt.temperature || properties.Station != "Sha Tin") {
+			t.Errorf("%s decoded to %+v, want temperature %v", tt.input, properties, tt.temperature)
+		}
+	}
+
+	useStore(t, newMemoryStore())
+	recorder := serve(t, http.MethodPost, "/api/features", `{"geometry": {"type": "Point", "coordinates": [114.17, 22.32]}, "properties": {"Air Temperature": "hot"}}`)
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), `"hot" is not a number`) {
+		t.Errorf("create with a non-numeric temperature = %d %s, want 400 naming the value", recorder.Code, recorder.Body)
+	}
+}
+
+func TestChangesLongPoll(t *testing.T) {
+	useStore(t, newMemoryStore(station("1", "Sha Tin", 114.18, 22.38, 28.1)))
+
+	if recorder := serve(t, http.MethodGet, "/api/features/changes?since=0&wait=50ms", ""); recorder.Code != http.StatusNotModified {
+		t.Errorf("idle long-poll status = %d, want 304", recorder.Code)
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		done <- serve(t, http.MethodGet, "/api/features/changes?since=0&wait=10s", "")
+	}()
+	select {
+	case recorder := <-done:
+		t.Fatalf("long-poll returned %d before any change", recorder.Code)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	created := createStation(t, "Tai Po", 114.16, 22.45)
+	select {
+	case recorder := <-done:
+		var changes FeatureChanges
+		decode(t, recorder, &changes)
+		if changes.Version != 1 || len(changes.Features) != 1 || changes.Features[0].(map[string]interface{})["id"] != created.ID {
+			t.Errorf("changes = %+v, want version 1 with only %s", changes, created.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("create did not wake the long-poll")
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	useStore(t, newMemoryStore(station("1", "Sha Tin", 114.18, 22.38, 28.1)))
+	handler := withRequestDeadline(newRouter())
+
+	tests := []struct {
+		deadline string
+		status   int
+	}{
+		{time.Now().Add(-time.Second).Format(time.RFC3339Nano), http.StatusServiceUnavailable},
+		{strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10), http.StatusServiceUnavailable},
+		{"tomorrow", http.StatusBadRequest},
+		{time.Now().Add(time.Minute).Format(time.RFC3339Nano), http.StatusOK},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/api/features/1", nil)
+		request.Header.Set("X-Request-Deadline", tt.deadline)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != tt.status {
+			t.Errorf("deadline %q status = %d, want %d", tt.deadline, recorder.Code, tt.status)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/features/changes?since=1&wait=10s", nil)
+	request.Header.Set("X-Request-Deadline", time.Now().Add(100*time.Millisecond).Format(time.RFC3339Nano))
+	recorder := httptest.NewRecorder()
+	started := time.Now()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusServiceUnavailable || time.Since(started) > 2*time.Second {
+		t.Errorf("long-poll past its deadline = %d after %s, want a prompt 503", recorder.Code, time.Since(started))
+	}
+}
+
+func TestAccuracyMetersRoundTrip(t *testing.T) {
+	useStore(t, newMemoryStore())
+
+	recorder := serve(t, http.MethodPost, "/api/features",
+		`{"type":"Feature","geometry":{"type":"Point","coordinates":[114.18,22.38]},"properties":{"Automatic Weather Station":"Sha Tin","Air Temperature":28.1,"accuracyMeters":12.5}}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("create status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	var created GeoJSONFeature
+	decode(t, recorder, &created)
+
+	var fetched GeoJSONFeature
+	decode(t, serve(t, http.MethodGet, "/api/features/"+created.ID, ""), &fetched)
+	if fetched.Properties.AccuracyMeters == nil || *fetched.Properties.AccuracyMeters != 12.5 {
+		t.Errorf("accuracyMeters = %v, want 12.5", fetched.Properties.AccuracyMeters)
+	}
+
+	recorder = serve(t, http.MethodPut, "/api/features/"+created.ID,
+		`{"type":"Feature","properties":{"Automatic Weather Station":"Sha Tin","Air Temperature":28.1,"accuracyMeters":-1}}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("negative accuracy status = %d, want 400", recorder.Code)
+	}
+	recorder = serve(t, http.MethodPost, "/api/features",
+		`{"type":"Feature","geometry":{"type":"Point","coordinates":[114.18,22.38]},"properties":{"Automatic Weather Station":"Tai Po","Air Temperature":26,"accuracyMeters":-0.5}}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("negative accuracy on create status = %d, want 400", recorder.Code)
+	}
+}
+
+func TestDefaultGeometryType(t *testing.T) {
+	body := `{"type":"Feature","geometry":{"coordinates":[114.18,22.38]},"properties":{"Automatic Weather Station":"Sha Tin","Air Temperature":28.1}}`
+
+	useStore(t, newMemoryStore())
+	recorder := serve(t, http.MethodPost, "/api/features", body)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("create status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	var created GeoJSONFeature
+	decode(t, recorder, &created)
+	stored, err := store.Get(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Geometry.Type != "Point" {
+		t.Errorf("stored geometry type = %q, want Point", stored.Geometry.Type)
+	}
+
+	override(t, &defaultGeometryType, "")
+	if recorder := serve(t, http.MethodPost, "/api/features", body); recorder.Code != http.StatusBadRequest {
+		t.Errorf("typeless geometry with defaulting disabled status = %d, want 400", recorder.Code)
+	}
+}
+
+func TestFeaturesWrap(t *testing.T) {
+	useStore(t, newMemoryStore(
+		station("1", "Sha Tin", 114.18, 22.38, 28.1),
+		station("2", "Tai Po", 114.16, 22.45, 26.4),
+	))
+
+	for _, target := range []string{"/api/features", "/api/features?wrap=true"} {
+		var collection struct {
+			Type     string           `json:"type"`
+			Features []GeoJSONFeature `json:"features"`
+		}
+		decode(t, serve(t, http.MethodGet, target, ""), &collection)
+		if collection.Type != "FeatureCollection" || len(collection.Features) != 2 {
+			t.Errorf("%s = %+v, want a FeatureCollection of 2 features", target, collection)
+		}
+	}
+
+	var features []GeoJSONFeature
+	decode(t, serve(t, http.MethodGet, "/api/features?wrap=false", ""), &features)
+	if len(features) != 2 || features[0].Type != "Feature" {
+		t.Errorf("wrap=false = %+v, want a bare array of 2 features", features)
+	}
+
+	if recorder := serve(t, http.MethodGet, "/api/features?wrap=maybe", ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("wrap=maybe status = %d, want 400", recorder.Code)
+	}
+}
+
+type mockStore struct {
+	features map[string]GeoJSONFeature
+	calls    []string
+	err      error
+}
+
+func (m *mockStore) List() ([]GeoJSONFeature, error) {
+	m.calls = append(m.calls, "List")
+	if m.err != nil {
+		return nil, m.err
+	}
+	var list []GeoJSONFeature
+	for _, id := range []string{"1", "2", "3"} {
+		if feature, ok := m.features[id]; ok {
+			list = append(list, feature)
+		}
+	}
+	return list, nil
+}
+
+func (m *mockStore) Get(id string) (GeoJSONFeature, error) {
+	m.calls = append(m.calls, "Get "+id)
+	if m.err != nil {
+		return GeoJSONFeature{}, m.err
+	}
+	feature, ok := m.features[id]
+	if !ok {
+		return GeoJSONFeature{}, errFeatureNotFound
+	}
+	return feature, nil
+}
+
+func (m *mockStore) Create(feature GeoJSONFeature) error {
+	m.calls = append(m.calls, "Create")
+	if m.err != nil {
+		return m.err
+	}
+	m.features[feature.ID] = feature
+	return nil
+}
+
+func (m *mockStore) Update(feature GeoJSONFeature) error {
+	m.calls = append(m.calls, "Update "+feature.ID)
+	if _, ok := m.features[feature.ID]; !ok {
+		return errFeatureNotFound
+	}
+	m.features[feature.ID] = feature
+	return nil
+}
+
+func (m *mockStore) Delete(id string) error {
+	m.calls = append(m.calls, "Delete "+id)
+	if _, ok := m.features[id]; !ok {
+		return errFeatureNotFound
+	}
+	delete(m.features, id)
+	return nil
+}
+
+func (m *mockStore) called(method string) bool {
+	for _, call := range m.calls {
+		if call == method {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHandlersUseFeatureStore(t *testing.T) {
+	mock := &mockStore{features: map[string]GeoJSONFeature{"1": station("1", "Sha Tin", 114.18, 22.38, 28.1)}}
+	useStore(t, mock)
+
+	tests := []struct {
+		method, target, body, call string
+		status                     int
+	}{
+		{http.MethodGet, "/api/features", "", "List", http.StatusOK},
+		{http.MethodGet, "/api/features/1", "", "Get 1", http.StatusOK},
+		{http.MethodGet, "/api/features/9", "", "Get 9", http.StatusNotFound},
+		{http.MethodPost, "/api/features", `{"type":"Feature","geometry":{"type":"Point","coordinates":[114.16,22.45]},"properties":{"Automatic Weather Station":"Tai Po","Air Temperature":26.4}}`, "Create", http.StatusOK},
+		{http.MethodPut, "/api/features/1", `{"type":"Feature","properties":{"Automatic Weather Station":"Sha Tin","Air Temperature":30}}`, "Update 1", http.StatusOK},
+		{http.MethodPut, "/api/features/9", `{"type":"Feature","properties":{"Automatic Weather Station":"Nowhere","Air Temperature":30}}`, "", http.StatusNotFound},
+		{http.MethodDelete, "/api/features/1", "", "Delete 1", http.StatusNoContent},
+		{http.MethodDelete, "/api/features/1", "", "Delete 1", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		mock.calls = nil
+		recorder := serve(t, tt.method, tt.target, tt.body)
+		if recorder.Code != tt.status {
+			t.Errorf("%s %s status = %d, want %d: %s", tt.method, tt.target, recorder.Code, tt.status, recorder.Body)
+		}
+		if tt.call != "" && !mock.called(tt.call) {
+			t.Errorf("%s %s calls = %v, want %s", tt.method, tt.target, mock.calls, tt.call)
+		}
+	}
+	if _, ok := mock.features["1"]; ok {
+		t.Error("feature 1 still in the store after delete")
+	}
+	if len(mock.features) != 1 {
+		t.Errorf("store holds %d features, want only the created one", len(mock.features))
+	}
+
+	mock.err = errors.New("connection refused")
+	if recorder := serve(t, http.MethodGet, "/api/features", ""); recorder.Code != http.StatusInternalServerError {
+		t.Errorf("List failure status = %d, want 500", recorder.Code)
+	}
+}
+
+func TestSQLiteStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "features.db")
+	sqlite, fresh, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fresh {
+		t.Error("new database not reported as fresh")
+	}
+
+	accuracy := 4.5
+	shaTin := station("1", "Sha Tin", 114.18, 22.38, 28.1)
+	shaTin.Properties.AccuracyMeters = &accuracy
+	for _, feature := range []GeoJSONFeature{shaTin, station("2", "Tai Po", 114.16, 22.45, 26.4), station("3", "Tuen Mun", 113.98, 22.39, 27)} {
+		if err := sqlite.Create(feature); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sqlite.Create(station("1", "Duplicate", 114, 22, 20)); err == nil {
+		t.Error("creating a duplicate id succeeded")
+	}
+	updated := station("2", "Tai Po", 114.16, 22.45, 31.2)
+	if err := sqlite.Update(updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlite.Delete("3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlite.Update(station("3", "Tuen Mun", 113.98, 22.39, 27)); !errors.Is(err, errFeatureNotFound) {
+		t.Errorf("updating a deleted feature = %v, want errFeatureNotFound", err)
+	}
+	if err := sqlite.Delete("3"); !errors.Is(err, errFeatureNotFound) {
+		t.Errorf("deleting twice = %v, want errFeatureNotFound", err)
+	}
+	if err := sqlite.SetVersion(7); err != nil {
+		t.Fatal(err)
+	}
+	sqlite.db.Close()
+
+	sqlite, fresh, err = openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+	if fresh {
+		t.Error("reopened database reported as fresh")
+	}
+
+	list, err := sqlite.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != "1" || list[1].ID != "2" {
+		t.Fatalf("reopened list = %+v, want features 1 and 2 in insertion order", list)
+	}
+	if list[0].Geometry != shaTin.Geometry || *list[0].Properties.AccuracyMeters != accuracy {
+		t.Errorf("feature 1 = %+v, want %+v", list[0], shaTin)
+	}
+	if got, err := sqlite.Get("2"); err != nil || got.Properties.AirTemperature != 31.2 {
+		t.Errorf("feature 2 = %+v, %v, want the updated temperature", got, err)
+	}
+	if _, err := sqlite.Get("3"); !errors.Is(err, errFeatureNotFound) {
+		t.Errorf("deleted feature = %v, want errFeatureNotFound", err)
+	}
+	if version, err := sqlite.Version(); err != nil || version != 7 {
+		t.Errorf("reopened version = %d, %v, want 7", version, err)
+	}
+}
+
+func TestOpenStoreSQLiteBackend(t *testing.T) {
+	t.Setenv("STORE_BACKEND", "sqlite")
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "features.db"))
+
+	opened, err := openStore(station("1", "Sha Tin", 114.18, 22.38, 28.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite, ok := opened.(*sqliteStore)
+	if !ok {
+		t.Fatalf("STORE_BACKEND=sqlite opened %T", opened)
+	}
+	if err := sqlite.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	sqlite.db.Close()
+
+	reopened, err := openStore(station("1", "Sha Tin", 114.18, 22.38, 28.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.(*sqliteStore).db.Close()
+	if list, err := reopened.List(); err != nil || len(list) != 0 {
+		t.Errorf("reopened store = %+v, %v, want the seed not reapplied", list, err)
+	}
+}
+
+func TestFileStorePersistsAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORE_BACKEND", "")
+	t.Setenv("FEATURES_FILE", filepath.Join(dir, "features.json"))
+	seed := station("seed", "Chek Lap Kok", 113.92, 22.31, 27.3)
+
+	opened, err := openStore(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "features.json")); err != nil {
+		t.Fatalf("seeded store was not written: %s", err)
+	}
+	useStore(t, opened)
+	created := createStation(t, "Sha Tin", 114.18, 22.38)
+	if recorder := serve(t, http.MethodPut, "/api/features/"+created.ID,
+		`{"type":"Feature","properties":{"Automatic Weather Station":"Sha Tin","Air Temperature":31.5}}`); recorder.Code != http.StatusOK {
+		t.Fatalf("update status = %d: %s", recorder.Code, recorder.Body)
+	}
+	if recorder := serve(t, http.MethodDelete, "/api/features/seed", ""); recorder.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d: %s", recorder.Code, recorder.Body)
+	}
+
+	reopened, err := openStore(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := reopened.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != created.ID || list[0].Properties.AirTemperature != 31.5 {
+		t.Errorf("after restart = %+v, want only the updated Sha Tin feature", list)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d entries, want no leftover temp files", len(entries))
+	}
+}
+
+func TestConcurrentCreatesAndReads(t *testing.T) {
+	useStore(t, newMemoryStore(station("1", "Sha Tin", 114.18, 22.38, 28.1)))
+	handler := newRouter()
+	const writers, readers = 20, 20
+
+	var wg sync.WaitGroup
+	failures := make(chan string, writers+readers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"type":"Feature","geometry":{"type":"Point","coordinates":[114.1%d,22.3]},"properties":{"Automatic Weather Station":"Station %d","Air Temperature":25}}`, i%10, i)
+			request := httptest.NewRequest(http.MethodPost, "/api/features", strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusOK {
+				failures <- fmt.Sprintf("create %d status = %d: %s", i, recorder.Code, recorder.Body)
+			}
+		}(i)
+	}
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := "/api/features"
+			if i%2 == 1 {
+				target = "/api/features/1"
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+			if recorder.Code != http.StatusOK {
+				failures <- fmt.Sprintf("GET %s status = %d", target, recorder.Code)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(failures)
+	for failure := range failures {
+		t.Error(failure)
+	}
+
+	var collection struct {
+		Features []GeoJSONFeature `json:"features"`
+	}
+	decode(t, serve(t, http.MethodGet, "/api/features?limit=1000", ""), &collection)
+	if len(collection.Features) != writers+1 {
+		t.Errorf("store holds %d features, want %d", len(collection.Features), writers+1)
+	}
+}
+
+func TestCreateGeometryValidation(t *testing.T) {
+	tests := []struct {
+		name, geometry string
+		status         int
+	}{
+		{"valid", `"geometry":{"type":"Point","coordinates":[114.18,22.38]},`, http.StatusOK},
+		{"typeless", `"geometry":{"coordinates":[114.18,22.38]},`, http.StatusOK},
+		{"missing", ``, http.StatusBadRequest},
+		{"null", `"geometry":null,`, http.StatusBadRequest},
+		{"longitude out of range", `"geometry":{"type":"Point","coordinates":[181,22.38]},`, http.StatusBadRequest},
+		{"latitude out of range", `"geometry":{"type":"Point","coordinates":[114.18,-91]},`, http.StatusBadRequest},
+		{"three coordinates", `"geometry":{"type":"Point","coordinates":[114.18,22.38,5]},`, http.StatusBadRequest},
+		{"one coordinate", `"geometry":{"type":"Point","coordinates":[114.18]},`, http.StatusBadRequest},
+		{"overflowing coordinate", `"geometry":{"type":"Point","coordinates":[1e400,22.38]},`, http.StatusBadRequest},
+		{"polygon", `"geometry":{"type":"Polygon","coordinates":[114.18,22.38]},`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useStore(t, newMemoryStore())
+			recorder := serve(t, http.MethodPost, "/api/features",
+				`{"type":"Feature",`+tt.geometry+`"properties":{"Automatic Weather Station":"Sha Tin","Air Temperature":28.1}}`)
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.status, recorder.Body)
+			}
+			list, err := store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.status != http.StatusOK {
+				if len(list) != 0 {
+					t.Errorf("rejected feature was stored: %+v", list)
+				}
+				return
+			}
+			if len(list) != 1 || list[0].Geometry != (GeoJSONGeometry{Type: "Point", Coordinates: [2]float64{114.18, 22.38}}) {
+				t.Errorf("stored = %+v, want the submitted point", list)
+			}
+		})
+	}
+}
+
+func TestImportCSVReportsMalformedRows(t *testing.T) {
+	useStore(t, newMemoryStore())
+	csv := "station,lon,lat,temperature\n" +
+		"Sha Tin,114.18,22.38,28.1\n" +
+		"Tai Po,114.16,north,26.4\n" +
+		"Tuen Mun,113.98,22.39,27\n" +
+		"Tsuen Wan,114.11\n"
+
+	recorder := serve(t, http.MethodPost, "/api/features/import?format=csv", csv)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", recorder.Code, recorder.Body)
+	}
+	var response ImportResponse
+	decode(t, recorder, &response)
+	if response.Imported != 2 || response.Failed != 2 {
+		t.Errorf("import = %+v, want 2 imported and 2 failed", response)
+	}
+	wantLines := []int{3, 5}
+	if len(response.Errors) != len(wantLines) {
+		t.Fatalf("errors = %+v, want lines %v", response.Errors, wantLines)
+	}
+	for i, line := range wantLines {
+		if response.Errors[i].Line != line || response.Errors[i].Error == "" {
+			t.Errorf("error %d = %+v, want a message for line %d", i, response.Errors[i], line)
+		}
+	}
+
+	features, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, feature := range features {
+		names = append(names, feature.Properties.Station)
+	}
+	if fmt.Sprint(names) != "[Sha Tin Tuen Mun]" {
+		t.Errorf("stored stations = %v, want [Sha Tin Tuen Mun]", names)
+	}
+
+	if recorder := serve(t, http.MethodPost, "/api/features/import?format=xlsx", csv); recorder.Code != http.StatusBadRequest {
+		t.Errorf("unsupported format status = %d, want 400", recorder.Code)
+	}
+}
+
+func TestFeaturePagination(t *testing.T) {
+	useStore(t, newMemoryStore(
+		station("1", "Chek Lap Kok", 113.92, 22.31, 27.3),
+		station("2", "Sha Tin", 114.18, 22.38, 28.1),
+		station("3", "Tai Po", 114.16, 22.45, 26.4),
+		station("4", "Tsing Yi", 114.11, 22.34, 27.9),
+		station("5", "Wong Chuk Hang", 114.17, 22.25, 27.1),
+	))
+
+	tests := []struct {
+		query     string
+		ids       string
+		truncated bool
+	}{
+		{"limit=2", "1,2", true},
+		{"limit=2&page=1", "1,2", true},
+		{"limit=2&page=2", "3,4", true},
+		{"limit=2&page=3", "5", true},
+		{"limit=2&page=4", "", true},
+		{"limit=5", "1,2,3,4,5", false},
+		{"limit=10", "1,2,3,4,5", false},
+		{"offset=3", "4,5", true},
+		{"limit=2&offset=4", "5", true},
+		{"offset=5", "", true},
+		{"offset=0", "1,2,3,4,5", false},
+	}
+	for _, tt := range tests {
+		recorder := serve(t, http.MethodGet, "/api/features?"+tt.query, "")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s status = %d, body %s", tt.query, recorder.Code, recorder.Body)
+		}
+		var collection struct {
+			Features []GeoJSONFeature `json:"features"`
+			Meta     CollectionMeta   `json:"meta"`
+		}
+		decode(t, recorder, &collection)
+		ids := make([]string, len(collection.Features))
+		for i, feature := range collection.Features {
+			ids[i] = feature.ID
+		}
+		if got := strings.Join(ids, ","); got != tt.ids {
+			t.Errorf("%s ids = %s, want %s", tt.query, got, tt.ids)
+		}
+		if collection.Meta.Total != 5 || collection.Meta.Truncated != tt.truncated {
+			t.Errorf("%s meta = %+v, want total 5, truncated %v", tt.query, collection.Meta, tt.truncated)
+		}
+		if tt.truncated && collection.Meta.TruncatedReason != "pagination" {
+			t.Errorf("%s truncatedReason = %q, want pagination", tt.query, collection.Meta.TruncatedReason)
+		}
+	}
+
+	var collection map[string]interface{}
+	decode(t, serve(t, http.MethodGet, "/api/features", ""), &collection)
+	if _, ok := collection["meta"]; ok {
+		t.Errorf("unpaginated collection carries meta: %v", collection["meta"])
+	}
+
+	for _, query := range []string{"limit=0", "limit=-1", "limit=two", "offset=-1", "offset=1.5", "page=0&limit=2", "page=x&limit=2", "page=2", "page=1&offset=2&limit=2", "page=9223372036854775807&limit=2"} {
+		if recorder := serve(t, http.MethodGet, "/api/features?"+query, ""); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s status = %d, want 400", query, recorder.Code)
+		}
+	}
+}